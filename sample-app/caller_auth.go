@@ -0,0 +1,297 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrCallerMissingToken = errors.New("missing vault token or identity token")
+	ErrCallerInvalidToken = errors.New("invalid vault token or identity token")
+)
+
+// CallerTokenType is the kind of credential a caller authenticated with
+type CallerTokenType string
+
+const (
+	CallerTokenVault    CallerTokenType = "vault-token"    // verified with auth/token/lookup-self
+	CallerTokenIdentity CallerTokenType = "identity-token" // verified with identity/oidc/.well-known/keys
+)
+
+// Caller is an authenticated caller of our API
+type Caller struct {
+	TokenType CallerTokenType
+	EntityID  string   // empty for vault tokens which are not tied to an entity
+	Policies  []string // only known for vault tokens; includes the policies inherited from its entity & groups
+	Groups    []string // from the "groups" claim of identity tokens; looked up on demand for vault tokens
+
+	groupsKnown bool
+}
+
+// CallerRequirements are the conditions a caller must meet to use a route:
+// for each non-empty list, the caller must match at least one of its values
+type CallerRequirements struct {
+	Entities []string // entity ids
+	Groups   []string // identity group names
+	Policies []string // vault policies attached to the caller's token or inherited from its entity & groups
+}
+
+// ParseCallerRequirements parses route requirements of the form
+// "<route>=<entity|group|policy>:<value>", e.g. "/payments=group:billing".
+// Routes are given as registered (e.g. "/customers/:id") and may be listed
+// multiple times to add more requirements.
+func ParseCallerRequirements(definitions []string) (map[string]CallerRequirements, error) {
+	requirements := make(map[string]CallerRequirements)
+
+	for _, definition := range definitions {
+		definition = strings.TrimSpace(definition)
+		if definition == "" {
+			continue
+		}
+
+		route, rest, ok := strings.Cut(definition, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid route requirement %q: expected <route>=<entity|group|policy>:<value>", definition)
+		}
+
+		kind, value, ok := strings.Cut(rest, ":")
+		if !ok || !strings.HasPrefix(route, "/") || value == "" {
+			return nil, fmt.Errorf("invalid route requirement %q: expected <route>=<entity|group|policy>:<value>", definition)
+		}
+
+		r := requirements[route]
+
+		switch kind {
+		case "entity":
+			r.Entities = append(r.Entities, value)
+		case "group":
+			r.Groups = append(r.Groups, value)
+		case "policy":
+			r.Policies = append(r.Policies, value)
+		default:
+			return nil, fmt.Errorf("invalid route requirement %q: unknown kind %q", definition, kind)
+		}
+
+		requirements[route] = r
+	}
+
+	return requirements, nil
+}
+
+// CallerAuthenticator authenticates the callers of our API with Vault itself.
+// A caller presents either:
+//
+//	X-Vault-Token: <vault token>
+//	Authorization: Bearer <vault token or vault identity token>
+//
+// Vault tokens are looked up in Vault, and the results (along with the groups
+// of the token's entity) are cached for callerCacheTTL; identity tokens (JWTs
+// signed by Vault) are verified locally with the public keys published by
+// Vault. Identity tokens are only accepted if an audience is configured, so
+// that tokens minted for other services cannot be used against us.
+type CallerAuthenticator struct {
+	vault    *Vault
+	issuer   string // not checked if empty
+	audience string // identity tokens are rejected if empty
+
+	keys  *identityTokenKeys
+	cache callerCache // looked up vault tokens & entity groups
+}
+
+func NewCallerAuthenticator(v *Vault, issuer, audience string) *CallerAuthenticator {
+	return &CallerAuthenticator{
+		vault:    v,
+		issuer:   issuer,
+		audience: audience,
+		keys: &identityTokenKeys{
+			vault: v,
+		},
+	}
+}
+
+// Authenticate verifies the token presented by the caller of the request
+func (a *CallerAuthenticator) Authenticate(ctx context.Context, request *http.Request) (*Caller, error) {
+	token := request.Header.Get("X-Vault-Token")
+
+	if token == "" {
+		scheme, credentials, _ := strings.Cut(request.Header.Get("Authorization"), " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			token = strings.TrimSpace(credentials)
+		}
+	}
+
+	if token == "" {
+		return nil, ErrCallerMissingToken
+	}
+
+	if looksLikeJWT(token) {
+		return a.authenticateIdentityToken(ctx, token)
+	}
+
+	return a.authenticateVaultToken(ctx, token)
+}
+
+func (a *CallerAuthenticator) authenticateVaultToken(ctx context.Context, token string) (*Caller, error) {
+	if caller, ok := a.cache.getCaller(token); ok {
+		return caller, nil
+	}
+
+	secret, err := a.vault.LookupCallerToken(ctx, token)
+	if err != nil {
+		// vault answers 403 for tokens which are invalid or expired
+		if kind := vaultErrorKind(err); kind != nil && kind != ErrVaultForbidden {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", ErrCallerInvalidToken, err)
+	}
+
+	policies, err := callerPolicies(secret.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCallerInvalidToken, err)
+	}
+
+	entityID, _ := secret.Data["entity_id"].(string)
+
+	caller := Caller{
+		TokenType: CallerTokenVault,
+		EntityID:  entityID,
+		Policies:  policies,
+	}
+
+	tokenTTL, err := secret.TokenTTL()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCallerInvalidToken, err)
+	}
+
+	a.cache.setCaller(token, caller, tokenTTL)
+
+	return &caller, nil
+}
+
+// callerPolicies returns the policies attached to the looked up token along
+// with the ones it inherits from its entity & the entity's groups
+// (identity_policies), without duplicates
+func callerPolicies(data map[string]interface{}) ([]string, error) {
+	var policies []string
+
+	for _, field := range []string{"policies", "identity_policies"} {
+		if data[field] == nil {
+			continue
+		}
+
+		list, ok := data[field].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected %q type", field)
+		}
+
+		for _, item := range list {
+			policy, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected %q item type", field)
+			}
+			if !containsAny(policies, policy) {
+				policies = append(policies, policy)
+			}
+		}
+	}
+
+	return policies, nil
+}
+
+func (a *CallerAuthenticator) authenticateIdentityToken(ctx context.Context, token string) (*Caller, error) {
+	if a.audience == "" {
+		return nil, fmt.Errorf("%w: identity tokens are not accepted (no audience configured)", ErrCallerInvalidToken)
+	}
+
+	claims, err := verifyIdentityToken(ctx, a.keys, token)
+	if err != nil {
+		if errors.Is(err, ErrInvalidIdentityToken) {
+			return nil, fmt.Errorf("%w: %v", ErrCallerInvalidToken, err)
+		}
+		return nil, err // unable to fetch the keys from vault
+	}
+
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrCallerInvalidToken, claims.Issuer)
+	}
+
+	if !claims.Audience.contains(a.audience) {
+		return nil, fmt.Errorf("%w: unexpected audience %q", ErrCallerInvalidToken, claims.Audience)
+	}
+
+	return &Caller{
+		TokenType:   CallerTokenIdentity,
+		EntityID:    claims.Subject,
+		Groups:      claims.Groups,
+		groupsKnown: true,
+	}, nil
+}
+
+// Authorize returns a description of the first requirement the caller does
+// not meet, or "" if the caller meets all of them
+func (a *CallerAuthenticator) Authorize(ctx context.Context, caller *Caller, requirements CallerRequirements) (string, error) {
+	if len(requirements.Entities) > 0 && !containsAny(requirements.Entities, caller.EntityID) {
+		return "the caller's entity is not allowed to use this endpoint", nil
+	}
+
+	if len(requirements.Policies) > 0 && !containsAny(requirements.Policies, caller.Policies...) {
+		return fmt.Sprintf("the caller must have one of the following vault policies: %s", strings.Join(requirements.Policies, ", ")), nil
+	}
+
+	if len(requirements.Groups) > 0 {
+		if !caller.groupsKnown && caller.EntityID != "" {
+			groups, ok := a.cache.getGroups(caller.EntityID)
+			if !ok {
+				var err error
+				if groups, err = a.vault.LookupEntityGroups(ctx, caller.EntityID); err != nil {
+					return "", fmt.Errorf("unable to look up the caller's groups: %w", err)
+				}
+				a.cache.setGroups(caller.EntityID, groups)
+			}
+			caller.Groups = groups
+			caller.groupsKnown = true
+		}
+
+		if !containsAny(requirements.Groups, caller.Groups...) {
+			return fmt.Sprintf("the caller must be a member of one of the following groups: %s", strings.Join(requirements.Groups, ", ")), nil
+		}
+	}
+
+	return "", nil
+}
+
+func containsAny(allowed []string, values ...string) bool {
+	for _, a := range allowed {
+		for _, v := range values {
+			if v != "" && v == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkRouteRequirements makes sure that requirements were only given for
+// routes which exist
+func checkRouteRequirements(routes gin.RoutesInfo, requirements map[string]CallerRequirements) error {
+	known := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		known[route.Path] = true
+	}
+
+	for route := range requirements {
+		if !known[route] {
+			return fmt.Errorf("invalid route requirements: unknown route %q", route)
+		}
+	}
+
+	return nil
+}
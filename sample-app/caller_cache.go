@@ -0,0 +1,128 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// callerCacheTTL is how long a looked up vault token & the groups of an
+// entity are reused without asking Vault again; a revoked token or a changed
+// group membership is noticed within that time at most
+const callerCacheTTL = 30 * time.Second
+
+// callerCache caches the callers authenticated with a vault token, along with
+// the groups of their entities, so that we don't have to call Vault on every
+// request. Callers are keyed by a hash of their token (its accessor is only
+// known once the token has been looked up), so that the tokens themselves are
+// never kept in memory.
+type callerCache struct {
+	mutex   sync.Mutex
+	callers map[[sha256.Size]byte]callerCacheEntry
+	groups  map[string]groupsCacheEntry // by entity id
+}
+
+type callerCacheEntry struct {
+	caller    Caller
+	expiresAt time.Time
+}
+
+type groupsCacheEntry struct {
+	groups    []string
+	expiresAt time.Time
+}
+
+// getCaller returns a copy of the cached caller for the given vault token
+func (c *callerCache) getCaller(token string) (*Caller, bool) {
+	/* */ c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := sha256.Sum256([]byte(token))
+
+	entry, ok := c.callers[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		delete(c.callers, key)
+		return nil, false
+	}
+
+	caller := entry.caller
+
+	return &caller, true
+}
+
+// setCaller caches the caller for the given vault token, for no longer than
+// the token's remaining ttl (0 means the token does not expire)
+func (c *callerCache) setCaller(token string, caller Caller, tokenTTL time.Duration) {
+	/* */ c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ttl := callerCacheTTL
+	if tokenTTL > 0 && tokenTTL < ttl {
+		ttl = tokenTTL
+	}
+
+	if c.callers == nil {
+		c.callers = make(map[[sha256.Size]byte]callerCacheEntry)
+	}
+
+	now := time.Now()
+
+	// drop the expired entries, so that the cache does not grow forever
+	for key, entry := range c.callers {
+		if now.After(entry.expiresAt) {
+			delete(c.callers, key)
+		}
+	}
+
+	c.callers[sha256.Sum256([]byte(token))] = callerCacheEntry{
+		caller:    caller,
+		expiresAt: now.Add(ttl),
+	}
+}
+
+// getGroups returns the cached group names of the given entity
+func (c *callerCache) getGroups(entityID string) ([]string, bool) {
+	/* */ c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.groups[entityID]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		delete(c.groups, entityID)
+		return nil, false
+	}
+
+	return entry.groups, true
+}
+
+func (c *callerCache) setGroups(entityID string, groups []string) {
+	/* */ c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.groups == nil {
+		c.groups = make(map[string]groupsCacheEntry)
+	}
+
+	now := time.Now()
+
+	for id, entry := range c.groups {
+		if now.After(entry.expiresAt) {
+			delete(c.groups, id)
+		}
+	}
+
+	c.groups[entityID] = groupsCacheEntry{
+		groups:    groups,
+		expiresAt: now.Add(callerCacheTTL),
+	}
+}
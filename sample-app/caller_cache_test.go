@@ -0,0 +1,141 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeCallerVault mimics the token lookup & identity endpoints for a single
+// token whose entity is a member of the "billing" group, counting the
+// requests made to each endpoint
+func fakeCallerVault(t *testing.T, tokenTTL int, lookups, entityReads *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]interface{}
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/auth/token/lookup-self"):
+			atomic.AddInt32(lookups, 1)
+			if r.Header.Get("X-Vault-Token") != "caller-token" {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+				return
+			}
+			data = map[string]interface{}{
+				"entity_id": "entity-id",
+				"policies":  []string{"default", "client-policy"},
+				"ttl":       tokenTTL,
+			}
+
+		case strings.HasSuffix(r.URL.Path, "/identity/entity/id/entity-id"):
+			atomic.AddInt32(entityReads, 1)
+			data = map[string]interface{}{"group_ids": []string{"group-id"}}
+
+		case strings.HasSuffix(r.URL.Path, "/identity/group/id/group-id"):
+			data = map[string]interface{}{"name": "billing"}
+
+		default:
+			t.Errorf("unexpected request to %q", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	})
+}
+
+func TestCallerCache(t *testing.T) {
+	var lookups, entityReads int32
+
+	authenticator := NewCallerAuthenticator(newTestVault(t, fakeCallerVault(t, 3600, &lookups, &entityReads)), "", "")
+
+	request := httptest.NewRequest(http.MethodGet, "/payments", nil)
+	request.Header.Set("X-Vault-Token", "caller-token")
+
+	for i := 0; i < 3; i++ {
+		caller, err := authenticator.Authenticate(context.Background(), request)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		failed, err := authenticator.Authorize(context.Background(), caller, CallerRequirements{Groups: []string{"billing"}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if failed != "" {
+			t.Fatalf("expected the caller to be authorized: %s", failed)
+		}
+	}
+
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Errorf("expected the token to be looked up once, got %d", n)
+	}
+
+	if n := atomic.LoadInt32(&entityReads); n != 1 {
+		t.Errorf("expected the entity to be read once, got %d", n)
+	}
+
+	// invalid tokens are not cached
+	request.Header.Set("X-Vault-Token", "another-token")
+
+	for i := 0; i < 2; i++ {
+		if _, err := authenticator.Authenticate(context.Background(), request); err == nil {
+			t.Fatal("expected an error for an invalid token")
+		}
+	}
+
+	if n := atomic.LoadInt32(&lookups); n != 3 {
+		t.Errorf("expected the invalid token to be looked up every time, got %d lookups", n)
+	}
+}
+
+func TestCallerCacheExpiry(t *testing.T) {
+	var cache callerCache
+
+	// the token expires before the cache ttl
+	cache.setCaller("short-lived-token", Caller{EntityID: "entity-id"}, time.Second)
+
+	for _, entry := range cache.callers {
+		if ttl := time.Until(entry.expiresAt); ttl > time.Second {
+			t.Errorf("expected the entry to expire with the token, got %s", ttl)
+		}
+	}
+
+	cache.setCaller("token", Caller{EntityID: "entity-id"}, 0)
+	cache.setGroups("entity-id", []string{"billing"})
+
+	for key, entry := range cache.callers {
+		entry.expiresAt = time.Now().Add(-time.Second)
+		cache.callers[key] = entry
+	}
+	for id, entry := range cache.groups {
+		entry.expiresAt = time.Now().Add(-time.Second)
+		cache.groups[id] = entry
+	}
+
+	if _, ok := cache.getCaller("token"); ok {
+		t.Error("expected the caller to have expired")
+	}
+
+	if _, ok := cache.getGroups("entity-id"); ok {
+		t.Error("expected the groups to have expired")
+	}
+
+	if _, ok := cache.callers[sha256.Sum256([]byte("token"))]; ok {
+		t.Error("expected the expired caller to be removed")
+	}
+
+	if _, ok := cache.groups["entity-id"]; ok {
+		t.Error("expected the expired groups to be removed")
+	}
+}
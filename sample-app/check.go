@@ -0,0 +1,220 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// ErrMissingCapabilities is returned by the 'check' command when our policies
+// do not grant everything the app needs
+var ErrMissingCapabilities = errors.New("the vault policies are missing some of the required capabilities")
+
+// CapabilityCheck is a vault path the app uses, along with the capabilities
+// it needs there
+type CapabilityCheck struct {
+	Path         string
+	Capabilities []string
+	UsedFor      string
+}
+
+// capabilityChecks lists the vault paths the app will use with the given
+// configuration; features which are not enabled are left out
+func (env Environment) capabilityChecks() ([]CapabilityCheck, error) {
+	var (
+		kv      = env.VaultAPIKeyMountPath
+		transit = env.VaultTransitMountPath
+		pki     = env.VaultPKIMountPath
+	)
+
+	checks := []CapabilityCheck{
+		// our own token & the leases created with it
+		{"auth/token/renew-self", []string{"update"}, "renew our auth token"},
+		{"sys/leases/renew", []string{"update"}, "renew the database credentials lease"},
+		{"sys/leases/revoke/" + env.VaultDatabaseCredsPath + "/*", []string{"update"}, "revoke the database credentials on shutdown"},
+		{"sys/leases/revoke/" + env.VaultDatabaseMigrationsCredsPath + "/*", []string{"update"}, "revoke the database credentials after 'migrate'"},
+
+		// static secrets
+		{kv + "/data/" + env.VaultAPIKeyPath, []string{"read", "update"}, "read the api key (POST /payments); rotate & roll it back (/admin)"},
+		{kv + "/metadata/" + env.VaultAPIKeyPath, []string{"read"}, "check for new api key versions; list them (/admin)"},
+
+		// dynamic secrets
+		{env.VaultDatabaseCredsPath, []string{"read"}, "database credentials"},
+		{env.VaultDatabaseMigrationsCredsPath, []string{"read"}, "database credentials for 'migrate'"},
+
+		// encryption of customer data
+		{transit + "/encrypt/" + env.VaultTransitCustomersKey, []string{"update"}, "encrypt customer data"},
+		{transit + "/decrypt/" + env.VaultTransitCustomersKey, []string{"update"}, "decrypt customer data"},
+	}
+
+	// encryption as a service
+	for _, key := range env.VaultTransitKeys {
+		checks = append(checks,
+			CapabilityCheck{transit + "/encrypt/" + key, []string{"update"}, "POST /encrypt"},
+			CapabilityCheck{transit + "/decrypt/" + key, []string{"update"}, "POST /decrypt"},
+			CapabilityCheck{transit + "/rewrap/" + key, []string{"update"}, "POST /rewrap"},
+			CapabilityCheck{transit + "/keys/" + key + "/rotate", []string{"update"}, "POST /rotate-key"},
+			CapabilityCheck{transit + "/keys/" + key, []string{"read"}, "POST /rotate-key"},
+		)
+	}
+
+	if env.MyTLS {
+		checks = append(checks, CapabilityCheck{pki + "/issue/" + env.VaultPKIServerRole, []string{"update"}, "issue the https certificate"})
+	}
+
+	// authenticating to the secure service
+	if env.SecureServiceMTLS {
+		checks = append(checks,
+			CapabilityCheck{pki + "/issue/" + env.VaultPKIClientRole, []string{"update"}, "issue the client certificate for the secure service"},
+			CapabilityCheck{pki + "/cert/ca", []string{"read"}, "verify the secure service's certificate"},
+		)
+	}
+
+	if mode := SigningMode(env.SecureServiceSigning); mode == SigningModeHMAC || mode == SigningModeSign {
+		checks = append(checks, CapabilityCheck{transit + "/" + string(mode) + "/" + env.SecureServiceSigningKey, []string{"update"}, "sign secure service requests"})
+	}
+
+	if env.SecureServiceIdentityTokenRole != "" {
+		checks = append(checks, CapabilityCheck{"identity/oidc/token/" + env.SecureServiceIdentityTokenRole, []string{"read"}, "mint identity tokens for the secure service"})
+	}
+
+	// webhooks
+	webhookProviders, err := ParseWebhookProviders(env.WebhookProviders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook providers: %w", err)
+	}
+
+	// sorted, so that the table is always in the same order
+	webhookProviderNames := make([]string, 0, len(webhookProviders))
+	for name := range webhookProviders {
+		webhookProviderNames = append(webhookProviderNames, name)
+	}
+	sort.Strings(webhookProviderNames)
+
+	for _, name := range webhookProviderNames {
+		provider := webhookProviders[name]
+
+		switch provider.Verification {
+		case WebhookVerificationTransitHMAC, WebhookVerificationTransitSign:
+			checks = append(checks, CapabilityCheck{transit + "/verify/" + provider.Key, []string{"update"}, fmt.Sprintf("verify %q webhooks", name)})
+		case WebhookVerificationKV:
+			checks = append(checks, CapabilityCheck{env.WebhookKVMountPath + "/data/" + provider.Key, []string{"read"}, fmt.Sprintf("verify %q webhooks", name)})
+		}
+	}
+
+	// callers which must be members of a group
+	routeRequirements, err := ParseCallerRequirements(env.AuthRoutes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid route requirements: %w", err)
+	}
+
+	for _, requirements := range routeRequirements {
+		if len(requirements.Groups) > 0 {
+			checks = append(checks,
+				CapabilityCheck{"identity/entity/id/*", []string{"read"}, "look up the groups of callers (AUTH_ROUTES)"},
+				CapabilityCheck{"identity/group/id/*", []string{"read"}, "look up the groups of callers (AUTH_ROUTES)"},
+			)
+			break
+		}
+	}
+
+	// named secrets
+	secretNames := make([]string, 0, len(env.Secrets))
+	for name := range env.Secrets {
+		secretNames = append(secretNames, name)
+	}
+	sort.Strings(secretNames)
+
+	for _, name := range secretNames {
+		definition := env.Secrets[name]
+
+		path := map[SecretEngine]string{
+			SecretEngineKVv2:     definition.Mount + "/data/" + definition.Path,
+			SecretEngineKVv1:     definition.Mount + "/" + definition.Path,
+			SecretEngineDatabase: definition.Mount + "/creds/" + definition.Path,
+		}[definition.Engine]
+
+		checks = append(checks, CapabilityCheck{path, []string{"read"}, fmt.Sprintf("the %q secret", name)})
+
+		if definition.Engine == SecretEngineDatabase {
+			checks = append(checks, CapabilityCheck{"sys/leases/revoke/" + path + "/*", []string{"update"}, fmt.Sprintf("revoke the %q secret on shutdown", name)})
+		}
+	}
+
+	return checks, nil
+}
+
+// check logs in to vault & verifies that our policies grant every capability
+// the app needs with the given configuration, so that a misconfigured policy
+// shows up before deploying rather than as a 403 on the first request. A
+// pass/fail table is written to w.
+func check(ctx context.Context, env Environment, w io.Writer) error {
+	checks, err := env.capabilityChecks()
+	if err != nil {
+		return err
+	}
+
+	// vault
+	vault, _, err := NewVaultAppRoleClient(ctx, env.vaultParameters())
+	if err != nil {
+		return fmt.Errorf("unable to initialize vault connection @ %s: %w", env.VaultAddress, err)
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(table, "RESULT\tPATH\tREQUIRED\tGRANTED\tUSED FOR")
+
+	failed := 0
+
+	for _, c := range checks {
+		result := "pass"
+
+		granted, err := vault.GetCapabilities(ctx, c.Path)
+		if err != nil {
+			return err
+		}
+
+		if missing := missingCapabilities(c.Capabilities, granted); len(missing) > 0 {
+			result = "FAIL (missing " + strings.Join(missing, ", ") + ")"
+			failed++
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", result, c.Path, strings.Join(c.Capabilities, ", "), strings.Join(granted, ", "), c.UsedFor)
+	}
+
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n%d of %d checks passed\n", len(checks)-failed, len(checks))
+
+	if failed > 0 {
+		return ErrMissingCapabilities
+	}
+
+	return nil
+}
+
+// missingCapabilities returns the required capabilities which are not granted
+func missingCapabilities(required, granted []string) []string {
+	if containsAny(granted, "root") {
+		return nil
+	}
+
+	var missing []string
+
+	for _, capability := range required {
+		if !containsAny(granted, capability) {
+			missing = append(missing, capability)
+		}
+	}
+
+	return missing
+}
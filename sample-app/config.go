@@ -0,0 +1,211 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v3"
+)
+
+const redactedValue = "<redacted>"
+
+// configFilePath finds the --config flag (or CONFIG_FILE environment
+// variable) ahead of the actual parsing, since the file has to be loaded
+// first; invalid arguments are reported by the actual parser
+func configFilePath(args []string) string {
+	var options struct {
+		ConfigFile string `env:"CONFIG_FILE" long:"config"`
+	}
+
+	parser := flags.NewParser(&options, flags.IgnoreUnknown)
+	_, _ = parser.ParseArgs(args)
+
+	return options.ConfigFile
+}
+
+// applyConfigFile loads a YAML (.yaml, .yml) or HCL (.hcl, .json) file whose
+// keys are the long flag names (e.g. "vault-address" or "vault_address") and
+// installs its values as the defaults of the matching options. Since go-flags
+// lets environment variables override defaults and flags override both, the
+// resulting precedence is: flags > env > file > defaults.
+//
+// The named secrets declared in the file's "secrets" section (which has no
+// flag or environment variable equivalent) are returned.
+func applyConfigFile(parser *flags.Parser, path string) (map[string]SecretDefinition, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	values := make(map[string]interface{})
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &values)
+	case ".hcl", ".json":
+		err = hcl.Decode(&values, string(b))
+	default:
+		return nil, fmt.Errorf("unsupported config file format %q: expected .yaml, .yml, .hcl or .json", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse config file %q: %w", path, err)
+	}
+
+	var secrets map[string]SecretDefinition
+
+	if section, ok := values["secrets"]; ok {
+		secrets, err = ParseSecretDefinitions(section)
+		if err != nil {
+			return nil, fmt.Errorf("config file %q: %w", path, err)
+		}
+		delete(values, "secrets")
+	}
+
+	// sorted, so that the first problem reported is always the same one
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := strings.ReplaceAll(key, "_", "-")
+
+		option := parser.FindOptionByLongName(name)
+		if option == nil || name == "config" {
+			return nil, fmt.Errorf("config file %q: unknown option %q", path, key)
+		}
+
+		defaults, err := configValues(values[key])
+		if err != nil {
+			return nil, fmt.Errorf("config file %q: option %q: %w", path, key, err)
+		}
+
+		if len(defaults) > 1 && option.Field().Type.Kind() != reflect.Slice {
+			return nil, fmt.Errorf("config file %q: option %q: expected a single value", path, key)
+		}
+
+		option.Default = defaults
+	}
+
+	return secrets, nil
+}
+
+// configValues converts a value decoded from a config file into the string
+// form go-flags expects
+func configValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			item, err := configValues(item)
+			if err != nil || len(item) != 1 {
+				return nil, fmt.Errorf("expected a list of scalar values")
+			}
+			values = append(values, item[0])
+		}
+		return values, nil
+	case map[string]interface{}, []map[string]interface{}:
+		return nil, fmt.Errorf("expected a scalar value or a list")
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
+
+// printConfig writes the effective configuration as YAML (which can be used
+// as a --config file), in the order the options are declared, followed by the
+// named secrets. Options tagged with `redact:"true"` are redacted.
+func printConfig(w io.Writer, parser *flags.Parser, secrets map[string]SecretDefinition) error {
+	document := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, option := range configOptions(parser.Groups()) {
+		value := configNode(reflect.ValueOf(option.Value()))
+
+		if option.Field().Tag.Get("redact") == "true" && !reflect.ValueOf(option.Value()).IsZero() {
+			value = &yaml.Node{Kind: yaml.ScalarNode, Value: redactedValue}
+		}
+
+		document.Content = append(document.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: option.LongName, HeadComment: option.Description},
+			value,
+		)
+	}
+
+	if len(secrets) > 0 {
+		value := &yaml.Node{}
+		if err := value.Encode(secrets); err != nil {
+			return fmt.Errorf("unable to encode secrets: %w", err)
+		}
+
+		document.Content = append(document.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: "secrets", HeadComment: "Named secrets, see Vault.Secret"},
+			value,
+		)
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+
+	if err := encoder.Encode(document); err != nil {
+		return fmt.Errorf("unable to encode config: %w", err)
+	}
+
+	return encoder.Close()
+}
+
+// configOptions lists the options of the given groups & their subgroups,
+// except the ones which only make sense on the command line
+func configOptions(groups []*flags.Group) []*flags.Option {
+	var options []*flags.Option
+
+	for _, group := range groups {
+		for _, option := range group.Options() {
+			switch option.LongName {
+			case "config", "print-config", "help":
+				continue
+			}
+			options = append(options, option)
+		}
+		options = append(options, configOptions(group.Groups())...)
+	}
+
+	return options
+}
+
+func configNode(v reflect.Value) *yaml.Node {
+	if duration, ok := v.Interface().(time.Duration); ok {
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: duration.String()}
+	}
+
+	if v.Kind() == reflect.Slice {
+		node := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+		for i := 0; i < v.Len(); i++ {
+			node.Content = append(node.Content, configNode(v.Index(i)))
+		}
+		return node
+	}
+
+	node := &yaml.Node{}
+	if err := node.Encode(v.Interface()); err != nil {
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: fmt.Sprint(v.Interface())}
+	}
+
+	return node
+}
@@ -6,12 +6,13 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type DatabaseParameters struct {
@@ -31,6 +32,13 @@ type Database struct {
 	connection      *sql.DB
 	connectionMutex sync.Mutex
 	parameters      DatabaseParameters
+
+	// closed (and replaced) every time the connection is replaced; used to
+	// wait for a reconnect after postgres rejects the current credentials
+	connectionReplaced chan struct{}
+
+	// requests new credentials & a reconnect, see SetCredentialsRefreshFunc
+	credentialsRefreshFunc func()
 }
 
 type Product struct {
@@ -38,12 +46,24 @@ type Product struct {
 	Name string `json:"name"`
 }
 
+// Customer is a row in the customers table; Email & Address are stored as
+// transit ciphertext and must be decrypted before being returned to callers
+type Customer struct {
+	ID        int    `json:"id"`
+	FirstName string `json:"first_name" binding:"required"`
+	LastName  string `json:"last_name"  binding:"required"`
+	Email     string `json:"email"      binding:"required"`
+	Phone     string `json:"phone"      binding:"required"`
+	Address   string `json:"address"`
+}
+
 // NewDatabase establishes a database connection with the given Vault credentials
 func NewDatabase(ctx context.Context, parameters DatabaseParameters, credentials DatabaseCredentials) (*Database, error) {
 	database := &Database{
-		connection:      nil,
-		connectionMutex: sync.Mutex{},
-		parameters:      parameters,
+		connection:         nil,
+		connectionMutex:    sync.Mutex{},
+		parameters:         parameters,
+		connectionReplaced: make(chan struct{}),
 	}
 
 	// establish the first connection
@@ -117,6 +137,10 @@ func (db *Database) closeReplaceConnection(new *sql.DB) {
 
 	// replace with a new connection
 	db.connection = new
+
+	// wake up any queries waiting for new credentials
+	close(db.connectionReplaced)
+	db.connectionReplaced = make(chan struct{})
 }
 
 func (db *Database) Close() error {
@@ -130,39 +154,230 @@ func (db *Database) Close() error {
 	return nil
 }
 
+// SetCredentialsRefreshFunc registers a function which will be called when
+// postgres rejects the current credentials (e.g. the lease was revoked early,
+// the role was dropped, or Vault was restarted). The function must not block;
+// it should arrange for new credentials to be fetched and passed to Reconnect.
+func (db *Database) SetCredentialsRefreshFunc(f func()) {
+	db.credentialsRefreshFunc = f
+}
+
+// query runs the given function with the current connection. If postgres
+// rejects the current credentials, it requests new ones, waits for the
+// connection to be replaced, and retries the function once.
+func (db *Database) query(ctx context.Context, f func(connection *sql.DB) error) error {
+	replaced, err := db.queryOnce(ctx, f)
+	if err == nil || db.credentialsRefreshFunc == nil || !isAuthenticationError(err) {
+		return err
+	}
+
+	log.Printf("database credentials: rejected by the database; will request new credentials & retry: %v", err)
+
+	if err := db.waitForNewCredentials(ctx, replaced); err != nil {
+		return fmt.Errorf("unable to refresh database credentials: %w", err)
+	}
+
+	_, err = db.queryOnce(ctx, f)
+
+	return err
+}
+
+func (db *Database) queryOnce(ctx context.Context, f func(connection *sql.DB) error) (<-chan struct{}, error) {
+	/* */ db.connectionMutex.Lock()
+	defer db.connectionMutex.Unlock()
+
+	return db.connectionReplaced, f(db.connection)
+}
+
+// waitForNewCredentials requests a credentials refresh and blocks until the
+// connection is replaced. Concurrent callers which observed the same
+// connection share a single refresh: the first one to ask triggers it and
+// all of them are woken up by the same reconnect.
+func (db *Database) waitForNewCredentials(ctx context.Context, replaced <-chan struct{}) error {
+	select {
+	case <-replaced:
+		return nil // another request has already reconnected
+	default:
+	}
+
+	db.credentialsRefreshFunc()
+
+	select {
+	case <-replaced:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isAuthenticationError checks whether the error is postgres rejecting the
+// credentials, i.e. SQLSTATE 28P01 (invalid_password) or 28000
+// (invalid_authorization_specification)
+func isAuthenticationError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	return pqErr.Code == "28P01" || pqErr.Code == "28000"
+}
+
 // GetProducts is a simple query function to demonstrate that we have
 // successfully established a database connection with the credentials from
 // Vault
 func (db *Database) GetProducts(ctx context.Context) ([]Product, error) {
-	/* */ db.connectionMutex.Lock()
-	defer db.connectionMutex.Unlock()
-
 	const query = "SELECT id, name FROM products"
 
-	rows, err := db.connection.QueryContext(ctx, query)
+	var products []Product
+
+	err := db.query(ctx, func(connection *sql.DB) error {
+		products = []Product{} // an empty list rather than null
+
+		rows, err := connection.QueryContext(ctx, query)
+		if err != nil {
+			return fmt.Errorf("failed to execute %q query: %w", query, err)
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
+
+		for rows.Next() {
+			var p Product
+			if err := rows.Scan(
+				&p.ID,
+				&p.Name,
+			); err != nil {
+				return fmt.Errorf("failed to scan table row for %q query: %w", query, err)
+			}
+			products = append(products, p)
+		}
+
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("error after scanning %q query: %w", query, err)
+		}
+
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute %q query: %w", query, err)
+		return nil, err
 	}
-	defer func() {
-		_ = rows.Close()
-	}()
 
-	var products []Product
+	return products, nil
+}
+
+// sensitiveFields returns pointers to the customer fields which must be
+// encrypted at rest
+func (c *Customer) sensitiveFields() []*string {
+	return []*string{
+		&c.Email,
+		&c.Address,
+	}
+}
+
+// ErrCustomerNotFound is returned when the requested customer does not exist
+var ErrCustomerNotFound = errors.New("customer not found")
+
+// GetCustomers returns all customers; sensitive fields are returned exactly
+// as stored (encrypted)
+func (db *Database) GetCustomers(ctx context.Context) ([]Customer, error) {
+	const query = "SELECT id, first_name, last_name, email, phone, address FROM customers ORDER BY id"
+
+	var customers []Customer
+
+	err := db.query(ctx, func(connection *sql.DB) error {
+		customers = []Customer{} // an empty list rather than null
+
+		rows, err := connection.QueryContext(ctx, query)
+		if err != nil {
+			return fmt.Errorf("failed to execute %q query: %w", query, err)
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
+
+		for rows.Next() {
+			var c Customer
+			if err := rows.Scan(
+				&c.ID,
+				&c.FirstName,
+				&c.LastName,
+				&c.Email,
+				&c.Phone,
+				&c.Address,
+			); err != nil {
+				return fmt.Errorf("failed to scan table row for %q query: %w", query, err)
+			}
+			customers = append(customers, c)
+		}
+
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("error after scanning %q query: %w", query, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	for rows.Next() {
-		var p Product
-		if err := rows.Scan(
-			&p.ID,
-			&p.Name,
+	return customers, nil
+}
+
+// GetCustomer returns a single customer by id or ErrCustomerNotFound
+func (db *Database) GetCustomer(ctx context.Context, id int) (Customer, error) {
+	const query = "SELECT id, first_name, last_name, email, phone, address FROM customers WHERE id = $1"
+
+	var c Customer
+
+	err := db.query(ctx, func(connection *sql.DB) error {
+		if err := connection.QueryRowContext(ctx, query, id).Scan(
+			&c.ID,
+			&c.FirstName,
+			&c.LastName,
+			&c.Email,
+			&c.Phone,
+			&c.Address,
 		); err != nil {
-			return nil, fmt.Errorf("failed to scan table row for %q query: %w", query, err)
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrCustomerNotFound
+			}
+			return fmt.Errorf("failed to execute %q query: %w", query, err)
 		}
-		products = append(products, p)
+
+		return nil
+	})
+	if err != nil {
+		return Customer{}, err
 	}
 
-	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("error after scanning %q query: %w", query, err)
+	return c, nil
+}
+
+// CreateCustomer inserts a new customer and returns its id; the caller is
+// responsible for encrypting the sensitive fields beforehand
+func (db *Database) CreateCustomer(ctx context.Context, c Customer) (int, error) {
+	const query = "INSERT INTO customers (first_name, last_name, email, phone, address) VALUES ($1, $2, $3, $4, $5) RETURNING id"
+
+	var id int
+
+	err := db.query(ctx, func(connection *sql.DB) error {
+		if err := connection.QueryRowContext(
+			ctx,
+			query,
+			c.FirstName,
+			c.LastName,
+			c.Email,
+			c.Phone,
+			c.Address,
+		).Scan(&id); err != nil {
+			return fmt.Errorf("failed to execute %q query: %w", query, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	return products, nil
+	return id, nil
 }
@@ -6,10 +6,13 @@ CREATE TABLE IF NOT EXISTS products (
    name        VARCHAR(255)  NOT NULL
 );
 
+-- email & address are encrypted by the application using Vault's transit
+-- secrets engine, so they hold ciphertext (e.g. "vault:v1:...") not plaintext
 CREATE TABLE IF NOT EXISTS customers (
    id          serial        PRIMARY KEY,
    first_name  VARCHAR(50)   NOT NULL,
    last_name   VARCHAR(50)   NOT NULL,
-   email       VARCHAR(255)  NOT NULL,
-   phone       VARCHAR(15)   NOT NULL
+   email       TEXT          NOT NULL,
+   phone       VARCHAR(15)   NOT NULL,
+   address     TEXT          NOT NULL  DEFAULT ''
 );
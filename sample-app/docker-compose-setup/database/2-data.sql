@@ -6,7 +6,5 @@ VALUES
     ('Rustic Webcam'),
     ('Haunted Coloring Book');
 
-INSERT INTO customers (first_name, last_name, email, phone)
-VALUES
-    ('Winston', 'Higginsbury', 'higgs@example.com',    '555-555-5555'),
-    ('Vivian',  'Vavilov',     'vivivavi@example.com', '555-555-5556');
+-- NOTE: customers are not seeded here since their sensitive fields must be
+-- encrypted with Vault's transit secrets engine; use POST /customers instead
@@ -3,5 +3,20 @@
 
 CREATE ROLE vault_db_user LOGIN SUPERUSER PASSWORD 'vault_db_password';
 CREATE ROLE readonly NOINHERIT;
+CREATE ROLE readwrite NOINHERIT;
+CREATE ROLE migrator NOINHERIT;
 
 GRANT SELECT ON ALL TABLES IN SCHEMA public TO "readonly";
+
+GRANT SELECT ON ALL TABLES IN SCHEMA public TO "readwrite";
+GRANT INSERT, UPDATE, DELETE ON customers TO "readwrite";
+GRANT USAGE ON SEQUENCE customers_id_seq TO "readwrite";
+
+-- The "migrator" role owns the schema objects, so that the short-lived users
+-- Vault creates for the 'migrate' command can alter them without owning
+-- anything themselves (which would prevent Vault from dropping them)
+ALTER TABLE products OWNER TO "migrator";
+ALTER TABLE customers OWNER TO "migrator";
+GRANT CREATE ON SCHEMA public TO "migrator";
+
+ALTER DEFAULT PRIVILEGES FOR ROLE "migrator" IN SCHEMA public GRANT SELECT ON TABLES TO "readonly", "readwrite";
@@ -0,0 +1,70 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Verifies the requests which the web app signs with a vault transit key
+// instead of sending the api key (SECURE_SERVICE_SIGNING). The signed string
+// is built the same way as canonicalRequest in outbound_signing.go:
+//
+//   METHOD\nPATH[?QUERY]\nTIMESTAMP\nHEX(SHA256(BODY))
+//
+// and the signature is checked with transit/verify, using a token which can
+// verify signatures but not create them.
+import crypto from 'crypto';
+
+// requests signed longer ago (or further in the future) than this are
+// rejected, so that captured requests cannot be replayed later on
+const maxClockSkewSeconds = 300;
+
+function unauthorized(r) {
+    r.return(401, '{"error":"unauthorized"}');
+}
+
+async function verifySignature(r) {
+    const signature = r.headersIn['X-Signature'] || '';
+    const timestamp = r.headersIn['X-Signature-Timestamp'] || '';
+    const mode = r.headersIn['X-Signature-Mode'] || '';
+
+    if (!/^vault:v\d+:/.test(signature) || !/^\d+$/.test(timestamp) || (mode !== 'hmac' && mode !== 'sign')) {
+        return unauthorized(r);
+    }
+
+    if (Math.abs(Date.now() / 1000 - Number(timestamp)) > maxClockSkewSeconds) {
+        return unauthorized(r);
+    }
+
+    const digest = crypto.createHash('sha256').update(r.requestBuffer || '').digest('hex');
+    const canonical = [r.method.toUpperCase(), r.variables.request_uri, timestamp, digest].join('\n');
+
+    const request = { input: Buffer.from(canonical).toString('base64') };
+    request[mode === 'hmac' ? 'hmac' : 'signature'] = signature;
+
+    let valid;
+
+    try {
+        const reply = await ngx.fetch(`${process.env.VAULT_ADDRESS}/v1/transit/verify/${process.env.TRANSIT_SIGNING_KEY}`, {
+            method: 'POST',
+            headers: { 'X-Vault-Token': process.env.VAULT_TOKEN },
+            body: JSON.stringify(request),
+        });
+
+        if (reply.status >= 500) {
+            throw new Error(`vault responded with ${reply.status}`);
+        }
+
+        // vault responds with 400 to malformed signatures
+        const body = await reply.json();
+
+        valid = reply.ok && body.data && body.data.valid === true;
+    } catch (e) {
+        r.error(`unable to verify the request signature: ${e}`);
+        return r.return(502, '{"error":"unable to verify the request signature"}');
+    }
+
+    if (!valid) {
+        return unauthorized(r);
+    }
+
+    r.return(200, '{"message":"hello world!"}');
+}
+
+export default { verifySignature };
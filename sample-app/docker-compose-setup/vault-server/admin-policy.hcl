@@ -0,0 +1,9 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: MPL-2.0
+
+# Tokens with this policy attached are allowed to call the web app's /admin
+# endpoints. The app checks for the policy itself; the grant below only lets
+# administrators inspect the api key metadata directly in Vault as well.
+path "kv-v2/metadata/api-key" {
+  capabilities = ["read"]
+}
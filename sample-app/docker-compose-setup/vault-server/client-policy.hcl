@@ -0,0 +1,8 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: MPL-2.0
+
+# Callers of the web app authenticate with a token which has this policy
+# attached, or with an identity token minted through the role below
+path "identity/oidc/token/hello-vault-client" {
+  capabilities = ["read"]
+}
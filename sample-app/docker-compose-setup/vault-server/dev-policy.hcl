@@ -6,8 +6,112 @@ path "kv-v2/data/api-key" {
   capabilities = ["read", "update"]
 }
 
+# Allows checking the current version of the api key without reading it
+path "kv-v2/metadata/api-key" {
+  capabilities = ["read"]
+}
+
+# Allows reading the shared secrets used to verify incoming webhooks
+path "kv-v2/data/webhooks/*" {
+  capabilities = ["read"]
+}
+
 # Allows read-only access to the secret path that will be used
 # by Vault to handle generation of dynamic database credentials.
 path "database/creds/dev-readonly" {
   capabilities = ["read"]
 }
+
+# Same as above, for the role which is also allowed to modify customers
+path "database/creds/dev-readwrite" {
+  capabilities = ["read"]
+}
+
+# Short-lived privileged credentials used by the 'migrate' command
+path "database/creds/dev-migrations" {
+  capabilities = ["read"]
+}
+
+# Allows revoking database credentials leases as soon as they are no longer
+# needed instead of waiting for them to expire; the app passes the lease ID in
+# the path, so that no other lease can be revoked
+path "sys/leases/revoke/database/creds/*" {
+  capabilities = ["update"]
+}
+
+# Allows looking up the identity groups of callers presenting a vault token,
+# for routes which require the caller to be a member of a group
+path "identity/entity/id/*" {
+  capabilities = ["read"]
+}
+
+path "identity/group/id/*" {
+  capabilities = ["read"]
+}
+
+# Allows minting identity tokens for the web app's own entity, which it can
+# present to the secure service instead of the api key
+path "identity/oidc/token/hello-vault-app" {
+  capabilities = ["read"]
+}
+
+# Allows encrypting & decrypting customer data with the transit secrets engine
+path "transit/encrypt/customers" {
+  capabilities = ["update"]
+}
+
+path "transit/decrypt/customers" {
+  capabilities = ["update"]
+}
+
+# Allows the web app to offer encryption as a service with the "app-data" key,
+# including rewrapping existing ciphertexts & rotating the key
+path "transit/encrypt/app-data" {
+  capabilities = ["update"]
+}
+
+path "transit/decrypt/app-data" {
+  capabilities = ["update"]
+}
+
+path "transit/rewrap/app-data" {
+  capabilities = ["update"]
+}
+
+path "transit/keys/app-data/rotate" {
+  capabilities = ["update"]
+}
+
+path "transit/keys/app-data" {
+  capabilities = ["read"]
+}
+
+# Allows envelope encryption of large payloads with data keys wrapped by the
+# "app-data" key (they are unwrapped through transit/decrypt/app-data)
+path "transit/datakey/wrapped/app-data" {
+  capabilities = ["update"]
+}
+
+# Allows signing requests to the secure service with the "secure-service-signing" key
+path "transit/hmac/secure-service-signing" {
+  capabilities = ["update"]
+}
+
+path "transit/sign/secure-service-signing" {
+  capabilities = ["update"]
+}
+
+# Allows issuing certificates for the web app's https listener
+path "pki/issue/hello-vault-server" {
+  capabilities = ["update"]
+}
+
+# Allows issuing client certificates for mutual tls with the secure service
+path "pki/issue/hello-vault-client" {
+  capabilities = ["update"]
+}
+
+# Allows reading the ca certificate, to verify the secure service's certificate
+path "pki/cert/ca" {
+  capabilities = ["read"]
+}
@@ -32,6 +32,9 @@ vault login -no-print "${VAULT_DEV_ROOT_TOKEN_ID}"
 # ref: https://www.vaultproject.io/docs/concepts/policies
 vault policy write trusted-orchestrator-policy /vault/config/trusted-orchestrator-policy.hcl
 vault policy write dev-policy /vault/config/dev-policy.hcl
+vault policy write admin-policy /vault/config/admin-policy.hcl
+vault policy write client-policy /vault/config/client-policy.hcl
+vault policy write secure-service-policy /vault/config/secure-service-policy.hcl
 
 #####################################
 ######## APPROLE AUTH METHDO ########
@@ -69,6 +72,73 @@ vault token create \
     -policy=trusted-orchestrator-policy \
     -ttl="768h"
 
+# Configure a token for an administrator of our web app; the app lets callers
+# presenting a token with "admin-policy" attached use its /admin endpoints.
+vault token create \
+    -id="${ADMIN_TOKEN}" \
+    -policy=admin-policy \
+    -ttl="768h"
+
+# Configure a token for a regular caller of our web app's endpoints
+vault token create \
+    -id="${CLIENT_TOKEN}" \
+    -policy=client-policy \
+    -ttl="768h"
+
+# Configure a token for the simulated secure service, which it uses to verify
+# the signatures of the web app's requests
+vault token create \
+    -id="${SECURE_SERVICE_TOKEN}" \
+    -policy=secure-service-policy \
+    -ttl="768h"
+
+#####################################
+######## IDENTITY & OIDC TOKENS #####
+#####################################
+
+# Callers can also log in with a username & password; their tokens are tied to
+# an identity entity which is a member of the "hello-vault-clients" group
+# ref: https://www.vaultproject.io/docs/secrets/identity
+vault auth enable userpass
+
+vault write auth/userpass/users/"${CLIENT_USERNAME}" \
+    password="${CLIENT_PASSWORD}" \
+    token_policies=client-policy
+
+USERPASS_ACCESSOR=$(vault auth list | jq -r '."userpass/".accessor')
+CLIENT_ENTITY_ID=$(vault write identity/entity name=hello-vault-client | jq -r '.data.id')
+
+vault write identity/entity-alias \
+    name="${CLIENT_USERNAME}" \
+    canonical_id="${CLIENT_ENTITY_ID}" \
+    mount_accessor="${USERPASS_ACCESSOR}"
+
+vault write identity/group \
+    name=hello-vault-clients \
+    member_entity_ids="${CLIENT_ENTITY_ID}"
+
+# Entities can mint identity tokens (signed JWTs) which the web app verifies
+# with Vault's public keys (identity/oidc/.well-known/keys)
+# ref: https://www.vaultproject.io/docs/secrets/identity/identity-token
+vault write identity/oidc/config issuer="http://vault-server:8200"
+
+vault write identity/oidc/key/hello-vault \
+    allowed_client_ids="*" \
+    algorithm=RS256
+
+vault write identity/oidc/role/hello-vault-client \
+    key=hello-vault \
+    client_id=hello-vault \
+    ttl="15m" \
+    template='{"groups": {{identity.entity.groups.names}}}'
+
+# The web app's own entity (created on its first AppRole login) can mint
+# identity tokens for the secure service (SECURE_SERVICE_IDENTITY_TOKEN_ROLE)
+vault write identity/oidc/role/hello-vault-app \
+    key=hello-vault \
+    client_id=secure-service \
+    ttl="15m"
+
 #####################################
 ########## STATIC SECRETS ###########
 #####################################
@@ -80,6 +150,10 @@ vault secrets enable -path=kv-v2 kv-v2
 # Seed the kv-v2 store with an entry our web app will use
 vault kv put "${API_KEY_PATH}" "${API_KEY_FIELD}=my-secret-key"
 
+# Seed a shared secret used to verify the signatures of the "example" provider's
+# webhooks (POST /webhooks/example)
+vault kv put "kv-v2/webhooks/example" "secret=${WEBHOOK_EXAMPLE_SECRET}"
+
 #####################################
 ########## DYNAMIC SECRETS ##########
 #####################################
@@ -92,7 +166,7 @@ vault secrets enable database
 # ref: https://www.vaultproject.io/api/secret/databases/postgresql
 vault write database/config/my-postgresql-database \
     plugin_name=postgresql-database-plugin \
-    allowed_roles="dev-readonly" \
+    allowed_roles="dev-readonly,dev-readwrite,dev-migrations" \
     connection_url="postgresql://{{username}}:{{password}}@${DATABASE_HOSTNAME}:${DATABASE_PORT}/postgres?sslmode=disable" \
     username="vault_db_user" \
     password="vault_db_password"
@@ -112,6 +186,101 @@ vault write database/roles/dev-readonly \
     default_ttl="100s" \
     max_ttl="300s"
 
+# Same as above, but with the privileges of the "readwrite" role, which is
+# also allowed to modify the customers table
+vault write database/roles/dev-readwrite \
+    db_name=my-postgresql-database \
+    creation_statements="CREATE ROLE \"{{name}}\" WITH LOGIN PASSWORD '{{password}}' VALID UNTIL '{{expiration}}'; GRANT readwrite TO \"{{name}}\";" \
+    renew_statements="ALTER ROLE \"{{name}}\" WITH LOGIN PASSWORD '{{password}}' VALID UNTIL '{{expiration}}'; GRANT readwrite TO \"{{name}}\";" \
+    default_ttl="100s" \
+    max_ttl="300s"
+
+# A privileged role used only by the 'migrate' command to apply schema
+# migrations. The generated users act as the "migrator" role (which owns the
+# schema) and are short-lived since the app revokes them once it is done.
+vault write database/roles/dev-migrations \
+    db_name=my-postgresql-database \
+    creation_statements="CREATE ROLE \"{{name}}\" WITH LOGIN PASSWORD '{{password}}' VALID UNTIL '{{expiration}}'; GRANT migrator TO \"{{name}}\"; ALTER ROLE \"{{name}}\" SET role = 'migrator';" \
+    default_ttl="60s" \
+    max_ttl="300s"
+
+#####################################
+###### ENCRYPTION AS A SERVICE ######
+#####################################
+
+# Enable the transit secrets engine, which the web app uses to encrypt
+# sensitive customer data before it is stored in the database
+# ref: https://www.vaultproject.io/docs/secrets/transit
+vault secrets enable transit
+
+# Create a named encryption key for customer data
+vault write -f "transit/keys/${TRANSIT_CUSTOMERS_KEY}"
+
+# Create a named encryption key which the web app exposes to other services
+# through its /encrypt, /decrypt & /rewrap endpoints
+vault write -f "transit/keys/${TRANSIT_APP_DATA_KEY}"
+
+# Create an asymmetric key which the web app can use to sign its requests to the
+# secure service (SECURE_SERVICE_SIGNING=sign or hmac) instead of sending the
+# API key; the secure service verifies the signatures with the public key
+vault write "transit/keys/${TRANSIT_SIGNING_KEY}" type=ed25519
+
+#####################################
+######## PKI / CERTIFICATES #########
+#####################################
+
+# Enable the pki secrets engine & generate a root CA for our demo; in
+# production you would typically use an intermediate CA instead
+# ref: https://www.vaultproject.io/docs/secrets/pki
+vault secrets enable pki
+vault secrets tune -max-lease-ttl="87600h" pki
+
+vault write pki/root/generate/internal \
+    common_name="hello-vault-go demo root CA" \
+    ttl="87600h"
+
+# Allow the web app to issue short-lived certificates for its https listener
+#
+# NOTE: we use artificially low ttl values to demonstrate the renewal logic
+vault write pki/roles/hello-vault-server \
+    allowed_domains="localhost,app" \
+    allow_bare_domains=true \
+    allow_localhost=true \
+    server_flag=true \
+    client_flag=false \
+    max_ttl="1h"
+
+# Allow the web app to issue short-lived client certificates to authenticate
+# to the secure service with mutual tls (instead of the static api key)
+vault write pki/roles/hello-vault-client \
+    allowed_domains="hello-vault" \
+    allow_bare_domains=true \
+    server_flag=false \
+    client_flag=true \
+    max_ttl="1h"
+
+# Issue the certificate of the simulated secure service's https listener, which
+# only accepts client certificates signed by the same CA; nginx does not renew
+# certificates, so this one lives as long as the demo tokens
+vault write pki/roles/secure-service \
+    allowed_domains="secure-service,localhost" \
+    allow_bare_domains=true \
+    allow_localhost=true \
+    server_flag=true \
+    client_flag=false \
+    max_ttl="768h"
+
+vault write pki/issue/secure-service \
+    common_name="secure-service" \
+    alt_names="localhost" \
+    ttl="768h" > /tmp/secure-service-certificate.json
+
+jq -r '.data.certificate' /tmp/secure-service-certificate.json > "${SECURE_SERVICE_TLS_DIR}/server.crt"
+jq -r '.data.private_key' /tmp/secure-service-certificate.json > "${SECURE_SERVICE_TLS_DIR}/server.key"
+jq -r '.data.issuing_ca'  /tmp/secure-service-certificate.json > "${SECURE_SERVICE_TLS_DIR}/ca.crt"
+
+rm /tmp/secure-service-certificate.json
+
 # This container is now healthy
 touch /tmp/healthy
 
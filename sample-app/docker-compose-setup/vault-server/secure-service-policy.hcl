@@ -0,0 +1,8 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: MPL-2.0
+
+# The simulated secure service verifies the signatures of the web app's
+# requests (SECURE_SERVICE_SIGNING) with this policy; it cannot sign anything
+path "transit/verify/secure-service-signing" {
+  capabilities = ["update"]
+}
@@ -4,9 +4,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"strconv"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 )
@@ -14,53 +20,355 @@ import (
 type Handlers struct {
 	database             *Database
 	vault                *Vault
+	secureServiceMutex   sync.RWMutex // guards secureServiceAddress, which can be changed while running
 	secureServiceAddress string
+	secureServiceClient  *SecureServiceClient
+	secureServiceAuth    CredentialInjection  // how the api key is attached to secure service requests
+	secureServiceMTLS    bool                 // authenticate with a client certificate instead of the api key
+	secureServiceSigner  *RequestSigner       // if set, sign requests with a transit key instead of sending the api key
+	secureServiceTokens  *IdentityTokenSource // if set, send a vault identity token instead of the api key
+	transitKeys          []string             // transit keys exposed through the encryption as a service endpoints
+	webhooks             *WebhookVerifier
+}
+
+// maxPaymentRequestSize limits how much of the incoming payment request body
+// is buffered in memory (it may have to be re-sent to the secure service)
+const maxPaymentRequestSize = 1 << 20
+
+// forwardedPaymentRequestHeaders are the incoming request headers which are
+// passed on to the secure service; the rest (e.g. our callers' credentials)
+// are dropped. It must never include the credential header.
+var forwardedPaymentRequestHeaders = []string{
+	"Content-Type",
+	"Accept",
+	"Accept-Language",
+	"Idempotency-Key",
+}
+
+// forwardedPaymentResponseHeaders are the secure service response headers
+// which are passed back to the caller, in addition to the Content-Type
+var forwardedPaymentResponseHeaders = []string{
+	"Retry-After",
+	"Location",
 }
 
 // (POST /payments) : demonstrates fetching a static secret from Vault and using it to talk to another service
 func (h *Handlers) CreatePayment(c *gin.Context) {
-	// retrieve the secret from Vault
-	apiKey, err := h.vault.GetSecretAPIKey(c.Request.Context())
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	// an Idempotency-Key lets the secure service recognize (and us safely
+	// retry) the same payment, so we pass it along as is
+	if len(c.GetHeader("Idempotency-Key")) > 255 {
+		abortWithError(c, http.StatusBadRequest, errorCodeInvalidRequest, "Idempotency-Key header must not be longer than 255 characters")
 		return
 	}
 
-	request, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, h.secureServiceAddress, nil)
+	// the body is buffered since we might have to send it more than once
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxPaymentRequestSize))
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			abortWithError(c, http.StatusRequestEntityTooLarge, errorCodeRequestTooLarge, fmt.Sprintf("request body must not be larger than %d bytes", maxPaymentRequestSize))
+			return
+		}
+		abortWithError(c, http.StatusBadRequest, errorCodeInvalidRequest, fmt.Sprintf("could not read request body: %v", err))
 		return
 	}
 
-	// use the api key in our request header
-	request.Header.Set("X-API-KEY", apiKey)
+	var apiKey APIKey
 
-	response, err := http.DefaultClient.Do(request)
+	// retrieve the secret from Vault, unless we authenticate with a client
+	// certificate (mutual tls), a request signature or an identity token instead
+	if h.secureServiceUsesAPIKey() {
+		apiKey, err = h.vault.GetSecretAPIKey(c.Request.Context())
+		if err != nil {
+			abortWithInternalError(c, err)
+			return
+		}
+	}
+
+	response, err := h.callSecureService(c.Request, body, apiKey)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if errors.Is(err, ErrCircuitOpen) {
+			abortWithError(c, http.StatusServiceUnavailable, errorCodeSecureServiceUnavailable, "the secure service is temporarily unavailable")
+			return
+		}
+		if vaultErrorKind(err) != nil {
+			abortWithInternalError(c, err)
+			return
+		}
+		log.Printf("secure service error: %v", err)
+		abortWithError(c, http.StatusBadGateway, errorCodeSecureServiceError, "unable to reach the secure service")
 		return
 	}
+
+	// the api key might have been rotated since we read it, so re-read the
+	// newest version from Vault and retry once
+	if h.secureServiceUsesAPIKey() && isAuthFailure(response.StatusCode) {
+		retryAPIKey, ok, err := h.vault.GetRotatedSecretAPIKey(c.Request.Context(), apiKey)
+		if err != nil {
+			log.Printf("unable to check for a rotated api key: %v", err)
+		}
+
+		if ok {
+			log.Printf("secure service rejected api key version %d; retrying with version %d", apiKey.Version, retryAPIKey.Version)
+
+			retryResponse, err := h.callSecureService(c.Request, body, retryAPIKey)
+			if err != nil {
+				log.Printf("secure service retry error: %v", err)
+			} else {
+				_ = response.Body.Close()
+				response = retryResponse
+			}
+		}
+	}
+
+	// the identity token might have been revoked (e.g. along with our entity's
+	// previous token); mint a new one for the next request
+	if h.secureServiceTokens != nil && isAuthFailure(response.StatusCode) {
+		h.secureServiceTokens.Invalidate()
+	}
 	defer func() {
 		_ = response.Body.Close()
 	}()
 
-	// forward the response back to the caller
-	b, err := ioutil.ReadAll(response.Body)
+	// stream the response back to the caller
+	contentType := response.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	headers := make(map[string]string)
+	for _, header := range forwardedPaymentResponseHeaders {
+		if value := response.Header.Get(header); value != "" {
+			headers[header] = value
+		}
+	}
+
+	c.DataFromReader(response.StatusCode, response.ContentLength, contentType, response.Body, headers)
+}
+
+// SecureServiceAddress returns the current address of the secure service
+func (h *Handlers) SecureServiceAddress() string {
+	/* */ h.secureServiceMutex.RLock()
+	defer h.secureServiceMutex.RUnlock()
+
+	return h.secureServiceAddress
+}
+
+// SetSecureServiceAddress points the payment requests to a different secure
+// service address; requests already in flight are not affected
+func (h *Handlers) SetSecureServiceAddress(address string) {
+	/* */ h.secureServiceMutex.Lock()
+	defer h.secureServiceMutex.Unlock()
+
+	h.secureServiceAddress = address
+}
+
+// callSecureService forwards the incoming request (its method, body &
+// selected headers) to the secure service authenticated with the given api
+// key (if any; with mutual tls, the client certificate is used) according to
+// the configured credential scheme or with our identity token, and signs it if
+// signing is enabled
+func (h *Handlers) callSecureService(incoming *http.Request, body []byte, apiKey APIKey) (*http.Response, error) {
+	// a bytes.Reader body can be rewound, so the client may retry the request
+	request, err := http.NewRequestWithContext(incoming.Context(), incoming.Method, h.SecureServiceAddress(), bytes.NewReader(body))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("could not read secure service response body: %v", err)})
-		return
+		return nil, err
+	}
+
+	for _, header := range forwardedPaymentRequestHeaders {
+		if value := incoming.Header.Get(header); value != "" {
+			request.Header.Set(header, value)
+		}
+	}
+
+	// attach the api key the way the secure service expects it
+	if apiKey.Value != "" {
+		if err := h.secureServiceAuth.Inject(request, apiKey); err != nil {
+			return nil, err
+		}
+	}
+
+	// or present our identity token
+	if h.secureServiceTokens != nil {
+		if err := h.secureServiceTokens.Inject(incoming.Context(), request); err != nil {
+			return nil, err
+		}
 	}
 
-	c.Data(response.StatusCode, "application/json", b)
+	// sign the request last, since the signature covers the final url
+	if h.secureServiceSigner != nil {
+		if err := h.secureServiceSigner.Sign(incoming.Context(), request, body); err != nil {
+			return nil, err
+		}
+	}
+
+	return h.secureServiceClient.Do(request)
+}
+
+// secureServiceUsesAPIKey checks whether we authenticate to the secure service
+// with the api key from Vault
+func (h *Handlers) secureServiceUsesAPIKey() bool {
+	return !h.secureServiceMTLS && h.secureServiceSigner == nil && h.secureServiceTokens == nil
+}
+
+// isAuthFailure checks whether the secure service rejected our credentials
+func isAuthFailure(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
 }
 
 // (GET /products) : demonstrates database authentication with dynamic secrets
 func (h *Handlers) GetProducts(c *gin.Context) {
 	products, err := h.database.GetProducts(c.Request.Context())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortWithInternalError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, products)
 }
+
+// (GET /customers) : demonstrates decrypting sensitive data with the transit secrets engine
+func (h *Handlers) GetCustomers(c *gin.Context) {
+	customers, err := h.database.GetCustomers(c.Request.Context())
+	if err != nil {
+		abortWithInternalError(c, err)
+		return
+	}
+
+	if err := h.decryptCustomers(c.Request.Context(), customers); err != nil {
+		abortWithInternalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, customers)
+}
+
+// (GET /customers/:id) : demonstrates decrypting sensitive data with the transit secrets engine
+func (h *Handlers) GetCustomer(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, errorCodeInvalidRequest, fmt.Sprintf("invalid customer id %q", c.Param("id")))
+		return
+	}
+
+	customer, err := h.database.GetCustomer(c.Request.Context(), id)
+	if err != nil {
+		if errors.Is(err, ErrCustomerNotFound) {
+			abortWithError(c, http.StatusNotFound, errorCodeNotFound, err.Error())
+			return
+		}
+		abortWithInternalError(c, err)
+		return
+	}
+
+	customers := []Customer{customer}
+
+	if err := h.decryptCustomers(c.Request.Context(), customers); err != nil {
+		abortWithInternalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, customers[0])
+}
+
+// (POST /customers) : demonstrates encrypting sensitive data with the transit secrets engine before storing it
+func (h *Handlers) CreateCustomer(c *gin.Context) {
+	var customer Customer
+
+	if err := c.ShouldBindJSON(&customer); err != nil {
+		abortWithError(c, http.StatusBadRequest, errorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	// the plaintext values are kept around to return them to the caller
+	encrypted := []Customer{customer}
+
+	if err := h.encryptCustomers(c.Request.Context(), encrypted); err != nil {
+		abortWithInternalError(c, err)
+		return
+	}
+
+	id, err := h.database.CreateCustomer(c.Request.Context(), encrypted[0])
+	if err != nil {
+		abortWithInternalError(c, err)
+		return
+	}
+
+	customer.ID = id
+
+	c.JSON(http.StatusCreated, customer)
+}
+
+// encryptCustomers replaces the sensitive fields of the given customers with
+// transit ciphertext, so that plaintext PII never reaches the database. All
+// fields are encrypted in a single batch request.
+func (h *Handlers) encryptCustomers(ctx context.Context, customers []Customer) error {
+	fields := nonEmptySensitiveFields(customers)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	inputs := make([]TransitInput, 0, len(fields))
+	for _, field := range fields {
+		inputs = append(inputs, TransitInput{Plaintext: []byte(*field)})
+	}
+
+	results, err := h.vault.TransitEncryptBatch(ctx, h.vault.parameters.transitCustomersKeyName, 0, inputs)
+	if err != nil {
+		return fmt.Errorf("unable to encrypt customer data: %w", err)
+	}
+
+	for i, result := range results {
+		if result.Error != "" {
+			return fmt.Errorf("unable to encrypt customer data: %s", result.Error)
+		}
+		*fields[i] = result.Ciphertext
+	}
+
+	return nil
+}
+
+// decryptCustomers replaces the transit ciphertext in the sensitive fields of
+// the given customers with the decrypted plaintext values. All fields are
+// decrypted in a single batch request.
+func (h *Handlers) decryptCustomers(ctx context.Context, customers []Customer) error {
+	fields := nonEmptySensitiveFields(customers)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	inputs := make([]TransitInput, 0, len(fields))
+	for _, field := range fields {
+		inputs = append(inputs, TransitInput{Ciphertext: *field})
+	}
+
+	results, err := h.vault.TransitDecryptBatch(ctx, h.vault.parameters.transitCustomersKeyName, inputs)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt customer data: %w", err)
+	}
+
+	for i, result := range results {
+		if result.Error != "" {
+			return fmt.Errorf("unable to decrypt customer data: %s", result.Error)
+		}
+		*fields[i] = string(result.Plaintext)
+	}
+
+	return nil
+}
+
+// nonEmptySensitiveFields returns pointers to the sensitive fields of the
+// given customers which have a value
+func nonEmptySensitiveFields(customers []Customer) []*string {
+	var fields []*string
+
+	for i := range customers {
+		for _, field := range customers[i].sensitiveFields() {
+			if *field != "" {
+				fields = append(fields, field)
+			}
+		}
+	}
+
+	return fields
+}
@@ -0,0 +1,132 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type APIKeyVersion struct {
+	Version      int        `json:"version"`
+	CreatedTime  time.Time  `json:"created_time"`
+	DeletionTime *time.Time `json:"deletion_time,omitempty"`
+	Destroyed    bool       `json:"destroyed"`
+}
+
+type APIKeyVersions struct {
+	CurrentVersion int             `json:"current_version"`
+	OldestVersion  int             `json:"oldest_version"`
+	MaxVersions    int             `json:"max_versions"`
+	PinnedVersion  int             `json:"pinned_version,omitempty"`
+	CachedVersion  int             `json:"cached_version,omitempty"`
+	Versions       []APIKeyVersion `json:"versions"`
+}
+
+type RollbackAPIKeyRequest struct {
+	Version int `json:"version" binding:"required,min=1"`
+}
+
+// APIKeyVersionResponse is returned after a new version of the api key has been written
+type APIKeyVersionResponse struct {
+	Version int `json:"version"`
+}
+
+// (GET /admin/api-key/versions) : demonstrates reading the version history & metadata of a kv-v2 secret
+func (h *Handlers) GetAPIKeyVersions(c *gin.Context) {
+	metadata, err := h.vault.GetSecretAPIKeyMetadata(c.Request.Context())
+	if err != nil {
+		abortWithInternalError(c, err)
+		return
+	}
+
+	versions, err := h.vault.GetSecretAPIKeyVersions(c.Request.Context())
+	if err != nil {
+		abortWithInternalError(c, err)
+		return
+	}
+
+	response := APIKeyVersions{
+		CurrentVersion: metadata.CurrentVersion,
+		OldestVersion:  metadata.OldestVersion,
+		MaxVersions:    metadata.MaxVersions,
+		PinnedVersion:  h.vault.parameters.apiKeyVersion,
+		Versions:       make([]APIKeyVersion, 0, len(versions)),
+	}
+
+	if cachedVersion, ok := h.vault.CachedSecretAPIKeyVersion(); ok {
+		response.CachedVersion = cachedVersion
+	}
+
+	for _, v := range versions {
+		version := APIKeyVersion{
+			Version:     v.Version,
+			CreatedTime: v.CreatedTime,
+			Destroyed:   v.Destroyed,
+		}
+		if !v.DeletionTime.IsZero() {
+			deletionTime := v.DeletionTime
+			version.DeletionTime = &deletionTime
+		}
+		response.Versions = append(response.Versions, version)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// (POST /admin/api-key/rollback) : demonstrates rolling a kv-v2 secret back to an earlier version
+func (h *Handlers) RollbackAPIKey(c *gin.Context) {
+	var request RollbackAPIKeyRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, errorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	version, err := h.vault.RollbackSecretAPIKey(c.Request.Context(), request.Version)
+	if err != nil {
+		abortWithVaultInputError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIKeyVersionResponse{Version: version})
+}
+
+// (POST /admin/api-key/rotate) : demonstrates writing a new version of a kv-v2 secret with check-and-set
+func (h *Handlers) RotateAPIKey(c *gin.Context) {
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		abortWithInternalError(c, err)
+		return
+	}
+
+	version, err := h.vault.RotateSecretAPIKey(c.Request.Context(), apiKey)
+	if err != nil {
+		if errors.Is(err, ErrAPIKeyVersionConflict) {
+			abortWithError(c, http.StatusConflict, errorCodeConflict, ErrAPIKeyVersionConflict.Error())
+			return
+		}
+		abortWithInternalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIKeyVersionResponse{Version: version})
+}
+
+// generateAPIKey returns a new random api key (32 bytes, hex-encoded)
+func generateAPIKey() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate a random api key: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,93 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Error string `json:"error"` // human readable, never contains raw Vault error text
+	Code  string `json:"code"`  // machine readable, see the errorCode* constants
+}
+
+const (
+	errorCodeInvalidRequest           = "invalid_request"
+	errorCodeRequestTooLarge          = "request_too_large"
+	errorCodeUnauthorized             = "unauthorized"
+	errorCodeForbidden                = "forbidden"
+	errorCodeNotFound                 = "not_found"
+	errorCodeConflict                 = "conflict"
+	errorCodeInternal                 = "internal_error"
+	errorCodeVaultNotFound            = "vault_not_found"
+	errorCodeVaultForbidden           = "vault_forbidden"
+	errorCodeVaultSealed              = "vault_sealed"
+	errorCodeVaultUnavailable         = "vault_unavailable"
+	errorCodeVaultRateLimited         = "vault_rate_limited"
+	errorCodeVaultInvalidRequest      = "vault_invalid_request"
+	errorCodeSecureServiceUnavailable = "secure_service_unavailable"
+	errorCodeSecureServiceError       = "secure_service_error"
+)
+
+// vaultErrorResponses maps each kind of Vault error to the response returned
+// to our callers. Vault is only ever called on our behalf, so its refusals are
+// our own (mis)configuration's fault and are answered with a 5xx; see
+// abortWithVaultInputError for calls made with the caller's input.
+var vaultErrorResponses = map[error]struct {
+	status  int
+	code    string
+	message string
+}{
+	ErrVaultNotFound:       {http.StatusInternalServerError, errorCodeVaultNotFound, "a secret or key used by this service was not found in vault"},
+	ErrVaultForbidden:      {http.StatusInternalServerError, errorCodeVaultForbidden, "this service is not permitted to perform the operation in vault"},
+	ErrVaultSealed:         {http.StatusServiceUnavailable, errorCodeVaultSealed, "vault is sealed"},
+	ErrVaultUnavailable:    {http.StatusServiceUnavailable, errorCodeVaultUnavailable, "vault is unavailable"},
+	ErrVaultRateLimited:    {http.StatusServiceUnavailable, errorCodeVaultRateLimited, "too many requests to vault, please retry later"},
+	ErrVaultInvalidRequest: {http.StatusBadGateway, errorCodeVaultInvalidRequest, "the request was rejected by vault"},
+}
+
+// abortWithError responds with the given status & an ErrorResponse; the
+// message must be safe to show to the caller
+func abortWithError(c *gin.Context, status int, code string, message string) {
+	c.AbortWithStatusJSON(status, ErrorResponse{
+		Error: message,
+		Code:  code,
+	})
+}
+
+// abortWithInternalError responds to an error which is not the caller's fault.
+// Vault errors are mapped to the matching status (e.g. 503 if Vault is sealed)
+// with a generic message; the original error is only logged.
+func abortWithInternalError(c *gin.Context, err error) {
+	log.Printf("%s %s error: %v", c.Request.Method, c.FullPath(), err)
+
+	if kind := vaultErrorKind(err); kind != nil {
+		response := vaultErrorResponses[kind]
+		abortWithError(c, response.status, response.code, response.message)
+		return
+	}
+
+	abortWithError(c, http.StatusInternalServerError, errorCodeInternal, "internal server error")
+}
+
+// abortWithVaultInputError responds to an error of a Vault call made with
+// input supplied by the caller (e.g. transit ciphertexts or a key version):
+// Vault rejecting that input, or not finding the requested version, is the
+// caller's fault. Any other error is handled by abortWithInternalError.
+func abortWithVaultInputError(c *gin.Context, err error) {
+	switch vaultErrorKind(err) {
+	case ErrVaultInvalidRequest:
+		log.Printf("%s %s error: %v", c.Request.Method, c.FullPath(), err)
+		abortWithError(c, http.StatusBadRequest, errorCodeVaultInvalidRequest, "the request was rejected by vault")
+	case ErrVaultNotFound:
+		log.Printf("%s %s error: %v", c.Request.Method, c.FullPath(), err)
+		abortWithError(c, http.StatusNotFound, errorCodeVaultNotFound, "the requested version was not found in vault")
+	default:
+		abortWithInternalError(c, err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCustomersEncryptionBatch(t *testing.T) {
+	var requests, unwraps int32
+
+	// encrypted fields are "vault:v1:<base64 plaintext>", which fakeDataKeys
+	// decrypts back to the plaintext
+	encrypt, decrypt := fakeTransit(t, 1), fakeDataKeys(t, &unwraps)
+
+	v := newTestVault(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		if strings.Contains(r.URL.Path, "/encrypt/") {
+			encrypt.ServeHTTP(w, r)
+		} else {
+			decrypt.ServeHTTP(w, r)
+		}
+	}))
+	v.parameters.transitCustomersKeyName = "app-data"
+
+	h := &Handlers{vault: v}
+
+	customers := []Customer{
+		{FirstName: "Ada", Email: "ada@example.com", Address: "1 Main St"},
+		{FirstName: "Grace", Email: "grace@example.com"}, // no address
+		{FirstName: "Alan", Email: "alan@example.com", Address: "2 Main St"},
+	}
+	plaintext := append([]Customer(nil), customers...)
+
+	if err := h.encryptCustomers(context.Background(), customers); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, customer := range customers {
+		if !strings.HasPrefix(customer.Email, "vault:v1:") {
+			t.Errorf("customer %d: expected an encrypted email, got %q", i, customer.Email)
+		}
+		if (customer.Address == "") != (plaintext[i].Address == "") {
+			t.Errorf("customer %d: expected empty fields to be left alone, got %q", i, customer.Address)
+		}
+	}
+
+	if err := h.decryptCustomers(context.Background(), customers); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := range customers {
+		if customers[i] != plaintext[i] {
+			t.Errorf("customer %d: expected %+v, got %+v", i, plaintext[i], customers[i])
+		}
+	}
+
+	// one batch request to encrypt & one to decrypt, for all customers
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected 2 requests to vault, got %d", n)
+	}
+
+	// nothing to encrypt or decrypt, so no request at all
+	if err := h.decryptCustomers(context.Background(), []Customer{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected no request for an empty list, got %d", n-2)
+	}
+}
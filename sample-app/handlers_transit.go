@@ -0,0 +1,214 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TransitItem mirrors a single item of the transit secrets engine API; all
+// binary values (plaintext, context, associated data) are base64-encoded
+type TransitItem struct {
+	Plaintext      string `json:"plaintext,omitempty"`
+	Ciphertext     string `json:"ciphertext,omitempty"`
+	Context        string `json:"context,omitempty"`
+	AssociatedData string `json:"associated_data,omitempty"`
+	KeyVersion     int    `json:"key_version,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// TransitRequest is either a single item or a batch of items (batch_input)
+type TransitRequest struct {
+	Key        string        `json:"key"         binding:"required"`
+	KeyVersion int           `json:"key_version"`
+	BatchInput []TransitItem `json:"batch_input"`
+	TransitItem
+}
+
+type TransitResponse struct {
+	BatchResults []TransitItem `json:"batch_results,omitempty"`
+	TransitItem
+}
+
+type TransitRotateKeyRequest struct {
+	Key string `json:"key" binding:"required"`
+}
+
+type TransitRotateKeyResponse struct {
+	Key           string `json:"key"`
+	LatestVersion int    `json:"latest_version"`
+}
+
+// (POST /encrypt) : demonstrates encryption as a service with the transit secrets engine
+func (h *Handlers) Encrypt(c *gin.Context) {
+	request, inputs, ok := h.bindTransitRequest(c)
+	if !ok {
+		return
+	}
+
+	results, err := h.vault.TransitEncryptBatch(c.Request.Context(), request.Key, request.KeyVersion, inputs)
+	if err != nil {
+		abortWithVaultInputError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, transitResponse(request, results))
+}
+
+// (POST /decrypt) : demonstrates encryption as a service with the transit secrets engine
+func (h *Handlers) Decrypt(c *gin.Context) {
+	request, inputs, ok := h.bindTransitRequest(c)
+	if !ok {
+		return
+	}
+
+	results, err := h.vault.TransitDecryptBatch(c.Request.Context(), request.Key, inputs)
+	if err != nil {
+		abortWithVaultInputError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, transitResponse(request, results))
+}
+
+// (POST /rewrap) : demonstrates re-encrypting data with the latest (or a specific) transit key version
+func (h *Handlers) Rewrap(c *gin.Context) {
+	request, inputs, ok := h.bindTransitRequest(c)
+	if !ok {
+		return
+	}
+
+	results, err := h.vault.TransitRewrapBatch(c.Request.Context(), request.Key, request.KeyVersion, inputs)
+	if err != nil {
+		abortWithVaultInputError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, transitResponse(request, results))
+}
+
+// (POST /rotate-key) : demonstrates rotating a transit key
+func (h *Handlers) RotateKey(c *gin.Context) {
+	var request TransitRotateKeyRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, errorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if !h.isAllowedTransitKey(request.Key) {
+		abortWithError(c, http.StatusForbidden, errorCodeForbidden, fmt.Sprintf("transit key %q is not allowed", request.Key))
+		return
+	}
+
+	version, err := h.vault.TransitRotateKey(c.Request.Context(), request.Key)
+	if err != nil {
+		abortWithInternalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, TransitRotateKeyResponse{Key: request.Key, LatestVersion: version})
+}
+
+// bindTransitRequest parses & validates the request, writing an error
+// response and returning false if it is invalid
+func (h *Handlers) bindTransitRequest(c *gin.Context) (TransitRequest, []TransitInput, bool) {
+	var request TransitRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, errorCodeInvalidRequest, err.Error())
+		return TransitRequest{}, nil, false
+	}
+
+	// only a known set of keys is exposed; in particular, the key protecting
+	// customer data must never be usable through these endpoints
+	if !h.isAllowedTransitKey(request.Key) {
+		abortWithError(c, http.StatusForbidden, errorCodeForbidden, fmt.Sprintf("transit key %q is not allowed", request.Key))
+		return TransitRequest{}, nil, false
+	}
+
+	items := request.BatchInput
+	if len(items) == 0 {
+		items = []TransitItem{request.TransitItem}
+	}
+
+	inputs := make([]TransitInput, 0, len(items))
+
+	for i, item := range items {
+		input, err := item.input()
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, errorCodeInvalidRequest, fmt.Sprintf("invalid item %d: %v", i, err))
+			return TransitRequest{}, nil, false
+		}
+		inputs = append(inputs, input)
+	}
+
+	return request, inputs, true
+}
+
+func (h *Handlers) isAllowedTransitKey(key string) bool {
+	for _, k := range h.transitKeys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// input decodes the base64-encoded fields of the item
+func (item TransitItem) input() (TransitInput, error) {
+	var (
+		input TransitInput
+		err   error
+	)
+
+	input.Ciphertext = item.Ciphertext
+	input.KeyVersion = item.KeyVersion
+
+	if input.Plaintext, err = base64.StdEncoding.DecodeString(item.Plaintext); err != nil {
+		return TransitInput{}, fmt.Errorf("plaintext must be base64-encoded: %w", err)
+	}
+	if input.Context, err = base64.StdEncoding.DecodeString(item.Context); err != nil {
+		return TransitInput{}, fmt.Errorf("context must be base64-encoded: %w", err)
+	}
+	if input.AssociatedData, err = base64.StdEncoding.DecodeString(item.AssociatedData); err != nil {
+		return TransitInput{}, fmt.Errorf("associated_data must be base64-encoded: %w", err)
+	}
+
+	return input, nil
+}
+
+// transitResponse mirrors the shape of the request: a single result for a
+// single item, or batch_results for a batch_input
+func transitResponse(request TransitRequest, results []TransitResult) TransitResponse {
+	items := make([]TransitItem, 0, len(results))
+
+	for _, r := range results {
+		item := TransitItem{
+			Ciphertext: r.Ciphertext,
+			KeyVersion: r.KeyVersion,
+		}
+		// vault's error text is only logged, see abortWithInternalError
+		if r.Error != "" {
+			log.Printf("transit batch item error: %s", r.Error)
+			item.Error = "the item was rejected by vault"
+		}
+		if r.Plaintext != nil {
+			item.Plaintext = base64.StdEncoding.EncodeToString(r.Plaintext)
+		}
+		items = append(items, item)
+	}
+
+	if len(request.BatchInput) == 0 && len(items) == 1 {
+		return TransitResponse{TransitItem: items[0]}
+	}
+
+	return TransitResponse{BatchResults: items}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxWebhookRequestSize limits how much of an incoming webhook is read
+const maxWebhookRequestSize = 1 << 20
+
+// processWebhook acts on the payload of an authenticated webhook; a real
+// application would parse the payload and act on the event
+func processWebhook(_ context.Context, provider string, payload []byte) error {
+	log.Printf("received %q webhook (%d bytes)", provider, len(payload))
+	return nil
+}
+
+// (POST /webhooks/:provider) : demonstrates verifying webhook signatures with keys held in Vault
+func (h *Handlers) ReceiveWebhook(c *gin.Context) {
+	provider := c.Param("provider")
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookRequestSize))
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			abortWithError(c, http.StatusRequestEntityTooLarge, errorCodeRequestTooLarge, fmt.Sprintf("request body must not be larger than %d bytes", maxWebhookRequestSize))
+			return
+		}
+		abortWithError(c, http.StatusBadRequest, errorCodeInvalidRequest, fmt.Sprintf("could not read request body: %v", err))
+		return
+	}
+
+	if err := h.webhooks.Verify(c.Request.Context(), provider, c.Request, body); err != nil {
+		switch {
+		case errors.Is(err, ErrWebhookUnknownProvider):
+			abortWithError(c, http.StatusNotFound, errorCodeNotFound, err.Error())
+		case errors.Is(err, ErrWebhookMissingSignature):
+			abortWithError(c, http.StatusBadRequest, errorCodeInvalidRequest, err.Error())
+		case errors.Is(err, ErrWebhookInvalidSignature), errors.Is(err, ErrWebhookExpired):
+			abortWithError(c, http.StatusUnauthorized, errorCodeUnauthorized, err.Error())
+		case errors.Is(err, ErrWebhookReplayed):
+			abortWithError(c, http.StatusConflict, errorCodeConflict, err.Error())
+		default:
+			abortWithInternalError(c, err)
+		}
+		return
+	}
+
+	if err := processWebhook(c.Request.Context(), provider, body); err != nil {
+		abortWithInternalError(c, err)
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
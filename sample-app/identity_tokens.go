@@ -0,0 +1,293 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers crypto.SHA256
+	_ "crypto/sha512" // registers crypto.SHA384 & crypto.SHA512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// identityTokenLeeway allows for small clock differences between Vault & us
+const identityTokenLeeway = 30 * time.Second
+
+// identityTokenKeysMinRefreshInterval limits how often the keys are fetched
+// again from Vault when a token is signed by a key we do not know (e.g. after
+// a key rotation), so that garbage tokens cannot hammer Vault
+const identityTokenKeysMinRefreshInterval = 10 * time.Second
+
+var ErrInvalidIdentityToken = errors.New("invalid identity token")
+
+// IdentityTokenClaims are the claims of a Vault identity token we care about.
+// The "groups" claim is not included by default: it must be added through the
+// role's template, e.g. {"groups": {{identity.entity.groups.names}}}.
+type IdentityTokenClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"` // the entity id
+	Audience  audience `json:"aud"`
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf"`
+	Expiry    int64    `json:"exp"`
+	Groups    []string `json:"groups"`
+}
+
+// audience may be a single string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(value string) bool {
+	for _, v := range a {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// identityTokenKeys caches the public keys of Vault's identity tokens, by key id
+type identityTokenKeys struct {
+	vault *Vault
+
+	mutex     sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// get returns the public key with the given id, fetching the keys from Vault
+// again if it is not known (yet)
+func (k *identityTokenKeys) get(ctx context.Context, keyID string) (crypto.PublicKey, error) {
+	/* */ k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if key, ok := k.keys[keyID]; ok {
+		return key, nil
+	}
+
+	if time.Since(k.fetchedAt) < identityTokenKeysMinRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrInvalidIdentityToken, keyID)
+	}
+
+	jwks, err := k.vault.GetIdentityTokenKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jwks))
+	for _, jwk := range jwks {
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("identity token key %q: %w", jwk.KeyID, err)
+		}
+		keys[jwk.KeyID] = key
+	}
+
+	k.keys = keys
+	k.fetchedAt = time.Now()
+
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrInvalidIdentityToken, keyID)
+	}
+
+	return key, nil
+}
+
+func (jwk JSONWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("malformed rsa modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("malformed rsa exponent: %w", err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("unsupported rsa exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("malformed ec x coordinate: %w", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("malformed ec y coordinate: %w", err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("malformed ed25519 public key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", jwk.KeyType)
+}
+
+// looksLikeJWT tells identity tokens (header.payload.signature) apart from
+// Vault tokens, which never contain dots
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// verifyIdentityToken checks the signature & the validity period of a Vault
+// identity token, and returns its claims. The issuer & audience are checked by
+// the caller.
+func verifyIdentityToken(ctx context.Context, keys *identityTokenKeys, token string) (IdentityTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return IdentityTokenClaims{}, fmt.Errorf("%w: malformed token", ErrInvalidIdentityToken)
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return IdentityTokenClaims{}, fmt.Errorf("%w: malformed header: %v", ErrInvalidIdentityToken, err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return IdentityTokenClaims{}, fmt.Errorf("%w: malformed signature", ErrInvalidIdentityToken)
+	}
+
+	key, err := keys.get(ctx, header.KeyID)
+	if err != nil {
+		return IdentityTokenClaims{}, err
+	}
+
+	if err := verifyJWTSignature(header.Algorithm, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return IdentityTokenClaims{}, fmt.Errorf("%w: %v", ErrInvalidIdentityToken, err)
+	}
+
+	var claims IdentityTokenClaims
+
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return IdentityTokenClaims{}, fmt.Errorf("%w: malformed claims: %v", ErrInvalidIdentityToken, err)
+	}
+
+	now := time.Now()
+
+	if claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(identityTokenLeeway)) {
+		return IdentityTokenClaims{}, fmt.Errorf("%w: expired", ErrInvalidIdentityToken)
+	}
+
+	if claims.NotBefore != 0 && now.Add(identityTokenLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return IdentityTokenClaims{}, fmt.Errorf("%w: not valid yet", ErrInvalidIdentityToken)
+	}
+
+	return claims, nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifyJWTSignature supports the algorithms Vault can sign identity tokens with
+func verifyJWTSignature(algorithm string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+
+	switch algorithm {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(edKey, signed, signature) {
+			return fmt.Errorf("signature verification failed")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "RS") {
+			return fmt.Errorf("algorithm %q does not match the rsa key", algorithm)
+		}
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, signature); err != nil {
+			return fmt.Errorf("signature verification failed")
+		}
+		return nil
+
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "ES") {
+			return fmt.Errorf("algorithm %q does not match the ec key", algorithm)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("signature verification failed")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("signature verification failed")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("algorithm %q does not match the key", algorithm)
+}
@@ -0,0 +1,309 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIdentityTokenIssuer   = "http://vault-server:8200/v1/identity/oidc"
+	testIdentityTokenAudience = "hello-vault"
+)
+
+// testIdentityTokenSigner signs identity tokens the way Vault does, with one
+// key of each type it supports
+type testIdentityTokenSigner struct {
+	ed25519Key ed25519.PrivateKey
+	rsaKey     *rsa.PrivateKey
+	ecdsaKey   *ecdsa.PrivateKey
+}
+
+func newTestIdentityTokenSigner(t *testing.T) *testIdentityTokenSigner {
+	t.Helper()
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testIdentityTokenSigner{
+		ed25519Key: ed25519Key,
+		rsaKey:     rsaKey,
+		ecdsaKey:   ecdsaKey,
+	}
+}
+
+// keys returns the public keys, as if they had just been fetched from vault;
+// vault is nil, so any attempt to fetch them again would panic
+func (s *testIdentityTokenSigner) keys() *identityTokenKeys {
+	return &identityTokenKeys{
+		keys: map[string]crypto.PublicKey{
+			"ed25519-key": s.ed25519Key.Public(),
+			"rsa-key":     &s.rsaKey.PublicKey,
+			"ecdsa-key":   &s.ecdsaKey.PublicKey,
+		},
+		fetchedAt: time.Now(),
+	}
+}
+
+// sign returns a token with the given header & claims, signed with the key
+// named by kid using the algorithm the key actually has (regardless of alg)
+func (s *testIdentityTokenSigner) sign(t *testing.T, alg, kid string, claims IdentityTokenClaims) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+
+	switch kid {
+	case "ed25519-key":
+		signature = ed25519.Sign(s.ed25519Key, []byte(signed))
+	case "rsa-key":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, s.rsaKey, crypto.SHA256, digest[:])
+	case "ecdsa-key":
+		r, sig, e := ecdsa.Sign(rand.Reader, s.ecdsaKey, digest[:])
+		signature, err = append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...), e
+	default:
+		signature = []byte("unknown key")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validTestIdentityTokenClaims() IdentityTokenClaims {
+	now := time.Now()
+
+	return IdentityTokenClaims{
+		Issuer:    testIdentityTokenIssuer,
+		Subject:   "entity-id",
+		Audience:  audience{testIdentityTokenAudience},
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expiry:    now.Add(time.Hour).Unix(),
+		Groups:    []string{"billing"},
+	}
+}
+
+func TestAuthenticateIdentityToken(t *testing.T) {
+	signer := newTestIdentityTokenSigner(t)
+
+	withClaims := func(modify func(*IdentityTokenClaims)) IdentityTokenClaims {
+		claims := validTestIdentityTokenClaims()
+		modify(&claims)
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		token   func(t *testing.T) string
+		wantErr bool
+	}{
+		{
+			name: "valid EdDSA token",
+			token: func(t *testing.T) string {
+				return signer.sign(t, "EdDSA", "ed25519-key", validTestIdentityTokenClaims())
+			},
+		},
+		{
+			name:  "valid RS256 token",
+			token: func(t *testing.T) string { return signer.sign(t, "RS256", "rsa-key", validTestIdentityTokenClaims()) },
+		},
+		{
+			name:  "valid ES256 token",
+			token: func(t *testing.T) string { return signer.sign(t, "ES256", "ecdsa-key", validTestIdentityTokenClaims()) },
+		},
+		{
+			name:    "rsa algorithm with an ec key",
+			token:   func(t *testing.T) string { return signer.sign(t, "RS256", "ecdsa-key", validTestIdentityTokenClaims()) },
+			wantErr: true,
+		},
+		{
+			name:    "ec algorithm with an rsa key",
+			token:   func(t *testing.T) string { return signer.sign(t, "ES256", "rsa-key", validTestIdentityTokenClaims()) },
+			wantErr: true,
+		},
+		{
+			name:    "EdDSA algorithm with an rsa key",
+			token:   func(t *testing.T) string { return signer.sign(t, "EdDSA", "rsa-key", validTestIdentityTokenClaims()) },
+			wantErr: true,
+		},
+		{
+			name:    "hmac algorithm with an rsa key",
+			token:   func(t *testing.T) string { return signer.sign(t, "HS256", "rsa-key", validTestIdentityTokenClaims()) },
+			wantErr: true,
+		},
+		{
+			name: "alg none",
+			token: func(t *testing.T) string {
+				token := signer.sign(t, "none", "ed25519-key", validTestIdentityTokenClaims())
+				return token[:strings.LastIndex(token, ".")+1] // no signature
+			},
+			wantErr: true,
+		},
+		{
+			name: "tampered claims",
+			token: func(t *testing.T) string {
+				token := signer.sign(t, "EdDSA", "ed25519-key", validTestIdentityTokenClaims())
+				other := signer.sign(t, "EdDSA", "ed25519-key", withClaims(func(c *IdentityTokenClaims) { c.Subject = "another-entity-id" }))
+				return other[:strings.LastIndex(other, ".")] + token[strings.LastIndex(token, "."):]
+			},
+			wantErr: true,
+		},
+		{
+			name: "expired",
+			token: func(t *testing.T) string {
+				return signer.sign(t, "EdDSA", "ed25519-key", withClaims(func(c *IdentityTokenClaims) {
+					c.Expiry = time.Now().Add(-identityTokenLeeway - time.Minute).Unix()
+				}))
+			},
+			wantErr: true,
+		},
+		{
+			name: "expired within the leeway",
+			token: func(t *testing.T) string {
+				return signer.sign(t, "EdDSA", "ed25519-key", withClaims(func(c *IdentityTokenClaims) {
+					c.Expiry = time.Now().Add(-identityTokenLeeway / 2).Unix()
+				}))
+			},
+		},
+		{
+			name: "no expiry",
+			token: func(t *testing.T) string {
+				return signer.sign(t, "EdDSA", "ed25519-key", withClaims(func(c *IdentityTokenClaims) { c.Expiry = 0 }))
+			},
+			wantErr: true,
+		},
+		{
+			name: "not valid yet",
+			token: func(t *testing.T) string {
+				return signer.sign(t, "EdDSA", "ed25519-key", withClaims(func(c *IdentityTokenClaims) {
+					c.NotBefore = time.Now().Add(identityTokenLeeway + time.Minute).Unix()
+				}))
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong audience",
+			token: func(t *testing.T) string {
+				return signer.sign(t, "EdDSA", "ed25519-key", withClaims(func(c *IdentityTokenClaims) { c.Audience = audience{"secure-service"} }))
+			},
+			wantErr: true,
+		},
+		{
+			name: "one of several audiences",
+			token: func(t *testing.T) string {
+				return signer.sign(t, "EdDSA", "ed25519-key", withClaims(func(c *IdentityTokenClaims) {
+					c.Audience = audience{"secure-service", testIdentityTokenAudience}
+				}))
+			},
+		},
+		{
+			name: "wrong issuer",
+			token: func(t *testing.T) string {
+				return signer.sign(t, "EdDSA", "ed25519-key", withClaims(func(c *IdentityTokenClaims) { c.Issuer = "http://attacker/v1/identity/oidc" }))
+			},
+			wantErr: true,
+		},
+		{
+			// the keys were fetched less than identityTokenKeysMinRefreshInterval
+			// ago, so they must not be fetched again (vault is nil)
+			name: "unknown key id",
+			token: func(t *testing.T) string {
+				return signer.sign(t, "EdDSA", "unknown-key", validTestIdentityTokenClaims())
+			},
+			wantErr: true,
+		},
+		{
+			name:    "malformed token",
+			token:   func(t *testing.T) string { return "not.a.token" },
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := &CallerAuthenticator{
+				issuer:   testIdentityTokenIssuer,
+				audience: testIdentityTokenAudience,
+				keys:     signer.keys(),
+			}
+
+			caller, err := authenticator.authenticateIdentityToken(context.Background(), tt.token(t))
+
+			if tt.wantErr {
+				if !errors.Is(err, ErrCallerInvalidToken) {
+					t.Fatalf("expected %v, got %v", ErrCallerInvalidToken, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if caller.EntityID != "entity-id" || !containsAny(caller.Groups, "billing") {
+				t.Errorf("unexpected caller: %+v", caller)
+			}
+		})
+	}
+}
+
+func TestCallerPolicies(t *testing.T) {
+	policies, err := callerPolicies(map[string]interface{}{
+		"policies":          []interface{}{"default", "client-policy"},
+		"identity_policies": []interface{}{"admin-policy", "default"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(policies) != 3 || !containsAny(policies, "admin-policy") {
+		t.Errorf("expected the token & identity policies, got %v", policies)
+	}
+
+	policies, err = callerPolicies(map[string]interface{}{
+		"identity_policies": []interface{}{"admin-policy"},
+	})
+	if err != nil || len(policies) != 1 || policies[0] != "admin-policy" {
+		t.Errorf("expected the identity policies, got %v (%v)", policies, err)
+	}
+}
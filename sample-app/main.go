@@ -5,38 +5,160 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"os"
 	"sync"
 	"time"
 
-	"github.com/fvbock/endless"
 	"github.com/gin-gonic/gin"
 	"github.com/jessevdk/go-flags"
 )
 
 type Environment struct {
+	// All of the options below can also be set in a YAML or HCL file, keyed by their long flag names
+	ConfigFile  string `                                   env:"CONFIG_FILE"                                                                                             description:"YAML (.yaml, .yml) or HCL (.hcl, .json) file to read the options from; env variables & flags take precedence"               long:"config"`
+	PrintConfig bool   `                                                                                                                                                 description:"Print the effective configuration (secrets redacted) and exit"                                                              long:"print-config"`
+
+	// Any number of named secrets, declared in the "secrets" section of the config file; see SecretDefinition
+	Secrets map[string]SecretDefinition `no-flag:"true"`
+
 	// The address of this service
-	MyAddress string `               env:"MY_ADDRESS"                    default:":8080"                        description:"Listen to http traffic on this tcp address"             long:"my-address"`
+	MyAddress      string        `                         env:"MY_ADDRESS"                                    default:":8080"                                           description:"Listen to http traffic on this tcp address"                                                                                 long:"my-address"`
+	MyTLS          bool          `                         env:"MY_TLS"                                                                                                  description:"Serve https with a certificate issued by Vault PKI"                                                                         long:"my-tls"`
+	MyDrainTimeout time.Duration `                         env:"MY_DRAIN_TIMEOUT"                              default:"5s"                                              description:"How long in-flight requests may take to finish on shutdown"                                                                 long:"my-drain-timeout"`
 
 	// Vault address, approle login credentials, and secret locations
-	VaultAddress             string `env:"VAULT_ADDRESS"                 default:"localhost:8200"               description:"Vault address"                                          long:"vault-address"`
-	VaultApproleRoleID       string `env:"VAULT_APPROLE_ROLE_ID"         required:"true"                        description:"AppRole RoleID to log in to Vault"                      long:"vault-approle-role-id"`
-	VaultApproleSecretIDFile string `env:"VAULT_APPROLE_SECRET_ID_FILE"  default:"/tmp/secret"                  description:"AppRole SecretID file path to log in to Vault"          long:"vault-approle-secret-id-file"`
-	VaultAPIKeyPath          string `env:"VAULT_API_KEY_PATH"            default:"api-key"                      description:"Path to the API key used by 'secure-service'"           long:"vault-api-key-path"`
-	VaultAPIKeyMountPath     string `env:"VAULT_API_KEY_MOUNT_PATH"      default:"kv-v2"                        description:"The location where the KV v2 secrets engine has been mounted in Vault" long:"vault-api-key-mount-path"`
-	VaultAPIKeyField         string `env:"VAULT_API_KEY_FIELD"           default:"api-key-field"                description:"The secret field name for the API key"                  long:"vault-api-key-descriptor"`
-	VaultDatabaseCredsPath   string `env:"VAULT_DATABASE_CREDS_PATH"     default:"database/creds/dev-readonly"  description:"Temporary database credentials will be generated here"  long:"vault-database-creds-path"`
+	VaultAddress                     string        `       env:"VAULT_ADDRESS"                                 default:"localhost:8200"                                  description:"Vault address"                                                                                                              long:"vault-address"`
+	VaultApproleRoleID               string        `       env:"VAULT_APPROLE_ROLE_ID"                         required:"true"                                           description:"AppRole RoleID to log in to Vault"                                                                                          long:"vault-approle-role-id"                         redact:"true"`
+	VaultApproleSecretIDFile         string        `       env:"VAULT_APPROLE_SECRET_ID_FILE"                  default:"/tmp/secret"                                     description:"AppRole SecretID file path to log in to Vault"                                                                              long:"vault-approle-secret-id-file"`
+	VaultAPIKeyPath                  string        `       env:"VAULT_API_KEY_PATH"                            default:"api-key"                                         description:"Path to the API key used by 'secure-service'"                                                                               long:"vault-api-key-path"`
+	VaultAPIKeyMountPath             string        `       env:"VAULT_API_KEY_MOUNT_PATH"                      default:"kv-v2"                                           description:"The location where the KV v2 secrets engine has been mounted in Vault"                                                      long:"vault-api-key-mount-path"`
+	VaultAPIKeyField                 string        `       env:"VAULT_API_KEY_FIELD"                           default:"api-key-field"                                   description:"The secret field name for the API key"                                                                                      long:"vault-api-key-descriptor"`
+	VaultAPIKeyVersion               int           `       env:"VAULT_API_KEY_VERSION"                         default:"0"                                               description:"Pin a specific version of the API key (0 means the latest version)"                                                         long:"vault-api-key-version"`
+	VaultAPIKeyCacheTTL              time.Duration `       env:"VAULT_API_KEY_CACHE_TTL"                       default:"30s"                                             description:"How often the cached API key is checked for a new version (0 disables caching)"                                             long:"vault-api-key-cache-ttl"`
+	VaultAPIKeyCacheMaxStaleness     time.Duration `       env:"VAULT_API_KEY_CACHE_MAX_STALENESS"             default:"5m"                                              description:"How long the last good API key is served while Vault is unavailable"                                                        long:"vault-api-key-cache-max-staleness"`
+	VaultAPIKeyRotationGracePeriod   time.Duration `       env:"VAULT_API_KEY_ROTATION_GRACE_PERIOD"           default:"5m"                                              description:"For how long after a rotation the previous API key version is retried if the new one is rejected"                           long:"vault-api-key-rotation-grace-period"`
+	VaultAdminPolicy                 string        `       env:"VAULT_ADMIN_POLICY"                            default:"admin-policy"                                    description:"Vault policy a caller's token must have to use the /admin endpoints"                                                        long:"vault-admin-policy"`
+	VaultDatabaseCredsPath           string        `       env:"VAULT_DATABASE_CREDS_PATH"                     default:"database/creds/dev-readwrite"                    description:"Temporary database credentials will be generated here"                                                                      long:"vault-database-creds-path"`
+	VaultDatabaseMigrationsCredsPath string        `       env:"VAULT_DATABASE_MIGRATIONS_CREDS_PATH"          default:"database/creds/dev-migrations"                   description:"Short-lived privileged database credentials for 'migrate' will be generated here"                                           long:"vault-database-migrations-creds-path"`
+	VaultPKIMountPath                string        `       env:"VAULT_PKI_MOUNT_PATH"                          default:"pki"                                             description:"The location where the PKI secrets engine has been mounted in Vault"                                                        long:"vault-pki-mount-path"`
+	VaultPKIServerRole               string        `       env:"VAULT_PKI_SERVER_ROLE"                         default:"hello-vault-server"                              description:"PKI role used to issue this service's https certificate"                                                                    long:"vault-pki-server-role"`
+	VaultPKIServerCommonName         string        `       env:"VAULT_PKI_SERVER_COMMON_NAME"                  default:"localhost"                                       description:"Common name of this service's https certificate"                                                                            long:"vault-pki-server-common-name"`
+	VaultPKIServerAltNames           []string      `       env:"VAULT_PKI_SERVER_ALT_NAMES"                    env-delim:","                                             description:"Subject alternative names of this service's https certificate"                                                              long:"vault-pki-server-alt-names"`
+	VaultPKIServerTTL                time.Duration `       env:"VAULT_PKI_SERVER_TTL"                          default:"1h"                                              description:"Lifetime of this service's https certificate; it is re-issued after 2/3 of it"                                              long:"vault-pki-server-ttl"`
+	VaultPKIClientRole               string        `       env:"VAULT_PKI_CLIENT_ROLE"                         default:"hello-vault-client"                              description:"PKI role used to issue the client certificate for 'secure-service' mutual tls"                                              long:"vault-pki-client-role"`
+	VaultPKIClientCommonName         string        `       env:"VAULT_PKI_CLIENT_COMMON_NAME"                  default:"hello-vault"                                     description:"Common name of the client certificate for 'secure-service' mutual tls"                                                      long:"vault-pki-client-common-name"`
+	VaultPKIClientTTL                time.Duration `       env:"VAULT_PKI_CLIENT_TTL"                          default:"1h"                                              description:"Lifetime of the client certificate; it is re-issued after 2/3 of it"                                                        long:"vault-pki-client-ttl"`
+	VaultTransitMountPath            string        `       env:"VAULT_TRANSIT_MOUNT_PATH"                      default:"transit"                                         description:"The location where the transit secrets engine has been mounted in Vault"                                                    long:"vault-transit-mount-path"`
+	VaultTransitKeys                 []string      `       env:"VAULT_TRANSIT_KEYS"                            default:"app-data" env-delim:","                          description:"Transit keys exposed through the /encrypt, /decrypt, /rewrap & /rotate-key endpoints"                                       long:"vault-transit-keys"`
+	VaultTransitCustomersKey         string        `       env:"VAULT_TRANSIT_CUSTOMERS_KEY"                   default:"customers"                                       description:"Transit key used to encrypt sensitive customer data"                                                                        long:"vault-transit-customers-key"`
+	VaultTransitDataKeyCacheSize     int           `       env:"VAULT_TRANSIT_DATA_KEY_CACHE_SIZE"             default:"1000"                                            description:"How many unwrapped envelope encryption data keys are cached (0 disables caching)"                                           long:"vault-transit-data-key-cache-size"`
+	VaultTransitDataKeyCacheTTL      time.Duration `       env:"VAULT_TRANSIT_DATA_KEY_CACHE_TTL"              default:"5m"                                              description:"How long an unwrapped envelope encryption data key is cached"                                                               long:"vault-transit-data-key-cache-ttl"`
+
+	// Callers of our endpoints authenticate with Vault tokens or Vault identity tokens
+	AuthRoutes                []string `                   env:"AUTH_ROUTES"                                   env-delim:","                                             description:"Additional requirements callers must meet to use a route as <route>=<entity|group|policy>:<value>"                          long:"auth-routes"`
+	AuthIdentityTokenIssuer   string   `                   env:"AUTH_IDENTITY_TOKEN_ISSUER"                                                                              description:"Expected issuer of callers' identity tokens (not checked if empty)"                                                         long:"auth-identity-token-issuer"`
+	AuthIdentityTokenAudience string   `                   env:"AUTH_IDENTITY_TOKEN_AUDIENCE"                                                                            description:"Expected audience of callers' identity tokens (identity tokens are rejected if empty)"                                      long:"auth-identity-token-audience"`
+
+	// Requests are validated against the OpenAPI document served at /openapi.json
+	OpenAPIValidateResponses bool `                        env:"OPENAPI_VALIDATE_RESPONSES"                                                                              description:"Also validate responses against the OpenAPI document & log mismatches"                                                      long:"openapi-validate-responses"`
+
+	// Webhooks are verified with keys held in Vault
+	WebhookProviders   []string      `                     env:"WEBHOOK_PROVIDERS"                             env-delim:","                                             description:"Webhook providers as <name>=<transit-hmac|transit-sign|kv>:<transit key or kv-v2 path>"                                     long:"webhook-providers"`
+	WebhookTolerance   time.Duration `                     env:"WEBHOOK_TOLERANCE"                             default:"5m"                                              description:"How far a webhook's timestamp may be from the current time"                                                                 long:"webhook-tolerance"`
+	WebhookKVMountPath string        `                     env:"WEBHOOK_KV_MOUNT_PATH"                         default:"kv-v2"                                           description:"The location where the KV v2 secrets engine holding webhook shared secrets has been mounted in Vault"                       long:"webhook-kv-mount-path"`
+	WebhookKVField     string        `                     env:"WEBHOOK_KV_FIELD"                              default:"secret"                                          description:"The secret field name for webhook shared secrets"                                                                           long:"webhook-kv-field"`
+	WebhookKVCacheTTL  time.Duration `                     env:"WEBHOOK_KV_CACHE_TTL"                          default:"1m"                                              description:"How long webhook shared secrets are cached (0 disables caching)"                                                            long:"webhook-kv-cache-ttl"`
 
 	// We will connect to this database using Vault-generated dynamic credentials
-	DatabaseHostname string        ` env:"DATABASE_HOSTNAME"             required:"true"                        description:"PostgreSQL database hostname"                           long:"database-hostname"`
-	DatabasePort     string        ` env:"DATABASE_PORT"                 default:"5432"                         description:"PostgreSQL database port"                               long:"database-port"`
-	DatabaseName     string        ` env:"DATABASE_NAME"                 default:"postgres"                     description:"PostgreSQL database name"                               long:"database-name"`
-	DatabaseTimeout  time.Duration ` env:"DATABASE_TIMEOUT"              default:"10s"                          description:"PostgreSQL database connection timeout"                 long:"database-timeout"`
+	DatabaseHostname string        `                       env:"DATABASE_HOSTNAME"                             required:"true"                                           description:"PostgreSQL database hostname"                                                                                               long:"database-hostname"`
+	DatabasePort     string        `                       env:"DATABASE_PORT"                                 default:"5432"                                            description:"PostgreSQL database port"                                                                                                   long:"database-port"`
+	DatabaseName     string        `                       env:"DATABASE_NAME"                                 default:"postgres"                                        description:"PostgreSQL database name"                                                                                                   long:"database-name"`
+	DatabaseTimeout  time.Duration `                       env:"DATABASE_TIMEOUT"                              default:"10s"                                             description:"PostgreSQL database connection timeout"                                                                                     long:"database-timeout"`
 
 	// A service which requires a specific secret API key (stored in Vault)
-	SecureServiceAddress string `    env:"SECURE_SERVICE_ADDRESS"        required:"true"                        description:"3rd party service that requires secure credentials"     long:"secure-service-address"`
+	SecureServiceAddress string `                          env:"SECURE_SERVICE_ADDRESS"                        required:"true"                                           description:"3rd party service that requires secure credentials"                                                                         long:"secure-service-address"`
+	SecureServiceMTLS    bool   `                          env:"SECURE_SERVICE_MTLS"                                                                                     description:"Authenticate to 'secure-service' with a Vault PKI client certificate instead of the API key"                                long:"secure-service-mtls"`
+
+	// How the API key is attached to the requests to the secure service
+	SecureServiceAuth string `                             env:"SECURE_SERVICE_AUTH"                           default:"header:X-API-KEY"                                description:"How the API key is sent to 'secure-service' as <header|bearer|basic|query>[:<header name|username field|query parameter>]"  long:"secure-service-auth"`
+
+	// Sign requests to the secure service with a transit key instead of sending the API key
+	SecureServiceSigning    string `                       env:"SECURE_SERVICE_SIGNING"                        default:"none" choice:"none" choice:"hmac" choice:"sign"  description:"Sign requests to 'secure-service' with a transit key ('hmac' or 'sign') instead of sending the API key"                     long:"secure-service-signing"`
+	SecureServiceSigningKey string `                       env:"SECURE_SERVICE_SIGNING_KEY"                    default:"secure-service-signing"                          description:"Transit key used to sign requests to 'secure-service'"                                                                      long:"secure-service-signing-key"`
+
+	// Present a Vault identity token to the secure service instead of sending the API key
+	SecureServiceIdentityTokenRole          string        `env:"SECURE_SERVICE_IDENTITY_TOKEN_ROLE"                                                                      description:"Identity token role (identity/oidc/token/<role>) used to authenticate to 'secure-service' instead of the API key"           long:"secure-service-identity-token-role"`
+	SecureServiceIdentityTokenRefreshBefore time.Duration `env:"SECURE_SERVICE_IDENTITY_TOKEN_REFRESH_BEFORE"  default:"1m"                                              description:"How long before its expiry the identity token is replaced"                                                                  long:"secure-service-identity-token-refresh-before"`
+
+	// How we talk to the secure service
+	SecureServiceTimeout             time.Duration `       env:"SECURE_SERVICE_TIMEOUT"                        default:"5s"                                              description:"Timeout of each request attempt to 'secure-service'"                                                                        long:"secure-service-timeout"`
+	SecureServiceMaxRetries          int           `       env:"SECURE_SERVICE_MAX_RETRIES"                    default:"2"                                               description:"How many times idempotent requests to 'secure-service' are retried on transient failures"                                   long:"secure-service-max-retries"`
+	SecureServiceRetryBackoff        time.Duration `       env:"SECURE_SERVICE_RETRY_BACKOFF"                  default:"100ms"                                           description:"Initial delay between retries; doubled after every retry"                                                                   long:"secure-service-retry-backoff"`
+	SecureServiceMaxIdleConnsPerHost int           `       env:"SECURE_SERVICE_MAX_IDLE_CONNS_PER_HOST"        default:"16"                                              description:"Size of the keep-alive connection pool to 'secure-service'"                                                                 long:"secure-service-max-idle-conns-per-host"`
+	SecureServiceBreakerThreshold    int           `       env:"SECURE_SERVICE_BREAKER_THRESHOLD"              default:"5"                                               description:"Consecutive failures after which calls to 'secure-service' are suspended (0 disables the circuit breaker)"                  long:"secure-service-breaker-threshold"`
+	SecureServiceBreakerCooldown     time.Duration `       env:"SECURE_SERVICE_BREAKER_COOLDOWN"               default:"30s"                                             description:"How long calls to 'secure-service' are suspended before a trial request"                                                    long:"secure-service-breaker-cooldown"`
+}
+
+func (env Environment) vaultParameters() VaultParameters {
+	return VaultParameters{
+		address:                   env.VaultAddress,
+		approleRoleID:             env.VaultApproleRoleID,
+		approleSecretIDFile:       env.VaultApproleSecretIDFile,
+		apiKeyPath:                env.VaultAPIKeyPath,
+		apiKeyMountPath:           env.VaultAPIKeyMountPath,
+		apiKeyField:               env.VaultAPIKeyField,
+		apiKeyVersion:             env.VaultAPIKeyVersion,
+		apiKeyCacheTTL:            env.VaultAPIKeyCacheTTL,
+		apiKeyCacheMaxStaleness:   env.VaultAPIKeyCacheMaxStaleness,
+		apiKeyRotationGracePeriod: env.VaultAPIKeyRotationGracePeriod,
+		databaseCredentialsPath:   env.VaultDatabaseCredsPath,
+		pkiMountPath:              env.VaultPKIMountPath,
+		transitMountPath:          env.VaultTransitMountPath,
+		transitCustomersKeyName:   env.VaultTransitCustomersKey,
+		transitDataKeyCacheSize:   env.VaultTransitDataKeyCacheSize,
+		transitDataKeyCacheTTL:    env.VaultTransitDataKeyCacheTTL,
+		secrets:                   env.Secrets,
+	}
+}
+
+func (env Environment) serverCertificateParameters() CertificateParameters {
+	return CertificateParameters{
+		role:       env.VaultPKIServerRole,
+		commonName: env.VaultPKIServerCommonName,
+		altNames:   env.VaultPKIServerAltNames,
+		ttl:        env.VaultPKIServerTTL,
+	}
+}
+
+func (env Environment) clientCertificateParameters() CertificateParameters {
+	return CertificateParameters{
+		role:       env.VaultPKIClientRole,
+		commonName: env.VaultPKIClientCommonName,
+		ttl:        env.VaultPKIClientTTL,
+	}
+}
+
+func (env Environment) secureServiceClientParameters() SecureServiceClientParameters {
+	return SecureServiceClientParameters{
+		timeout:             env.SecureServiceTimeout,
+		maxRetries:          env.SecureServiceMaxRetries,
+		retryBackoff:        env.SecureServiceRetryBackoff,
+		maxIdleConnsPerHost: env.SecureServiceMaxIdleConnsPerHost,
+		breakerThreshold:    env.SecureServiceBreakerThreshold,
+		breakerCooldown:     env.SecureServiceBreakerCooldown,
+	}
+}
+
+func (env Environment) databaseParameters() DatabaseParameters {
+	return DatabaseParameters{
+		hostname: env.DatabaseHostname,
+		port:     env.DatabasePort,
+		name:     env.DatabaseName,
+		timeout:  env.DatabaseTimeout,
+	}
 }
 
 func main() {
@@ -45,101 +167,323 @@ func main() {
 
 	var env Environment
 
-	// parse & validate environment variables
-	_, err := flags.Parse(&env)
+	parser, err := newParser(&env, flags.Default)
 	if err != nil {
+		log.Fatalf("unable to initialize the command line parser: %v", err)
+	}
+
+	// parse & validate the config file, environment variables & flags
+	if err := loadEnvironment(parser, &env, os.Args[1:]); err != nil {
 		if flags.WroteHelp(err) {
 			os.Exit(0)
 		}
 		log.Fatalf("unable to parse environment variables: %v", err)
 	}
 
+	if env.PrintConfig {
+		if err := printConfig(os.Stdout, parser, env.Secrets); err != nil {
+			log.Fatalf("unable to print config: %v", err)
+		}
+		return
+	}
+
+	if parser.Active != nil && parser.Active.Name == "migrate" {
+		if err := migrate(context.Background(), env); err != nil {
+			log.Fatalf("migrate error: %v", err)
+		}
+		return
+	}
+
+	if parser.Active != nil && parser.Active.Name == "check" {
+		if err := check(context.Background(), env, os.Stdout); err != nil {
+			log.Fatalf("check error: %v", err)
+		}
+		return
+	}
+
 	if err := run(context.Background(), env); err != nil {
 		log.Fatalf("error: %v", err)
 	}
 }
 
+// newParser returns the parser of our options & commands, which fills in env
+func newParser(env *Environment, options flags.Options) (*flags.Parser, error) {
+	parser := flags.NewParser(env, options)
+	parser.SubcommandsOptional = true // the web server is started when no command is given
+
+	if _, err := parser.AddCommand(
+		"migrate",
+		"Apply database schema migrations",
+		"Apply database schema migrations using short-lived privileged database credentials from Vault",
+		&struct{}{},
+	); err != nil {
+		return nil, fmt.Errorf("unable to initialize %q command: %w", "migrate", err)
+	}
+
+	if _, err := parser.AddCommand(
+		"check",
+		"Check the Vault policy capabilities",
+		"Log in to Vault and check that its policies grant the capabilities this app needs on every path it uses",
+		&struct{}{},
+	); err != nil {
+		return nil, fmt.Errorf("unable to initialize %q command: %w", "check", err)
+	}
+
+	return parser, nil
+}
+
+// loadEnvironment fills in env from the config file, environment variables &
+// flags; see applyConfigFile for the precedence
+func loadEnvironment(parser *flags.Parser, env *Environment, args []string) error {
+	// values from the config file (if any) are used as defaults, which env
+	// variables & flags take precedence over
+	secrets, err := applyConfigFile(parser, configFilePath(args))
+	if err != nil {
+		return fmt.Errorf("unable to load config file: %w", err)
+	}
+
+	if _, err := parser.ParseArgs(args); err != nil {
+		return err
+	}
+
+	env.Secrets = secrets
+
+	return nil
+}
+
 func run(ctx context.Context, env Environment) error {
 	ctx, cancelContextFunc := context.WithCancel(ctx)
 	defer cancelContextFunc()
 
 	// vault
-	vault, authToken, err := NewVaultAppRoleClient(
-		ctx,
-		VaultParameters{
-			address:                 env.VaultAddress,
-			approleRoleID:           env.VaultApproleRoleID,
-			approleSecretIDFile:     env.VaultApproleSecretIDFile,
-			apiKeyPath:              env.VaultAPIKeyPath,
-			apiKeyMountPath:         env.VaultAPIKeyMountPath,
-			apiKeyField:             env.VaultAPIKeyField,
-			databaseCredentialsPath: env.VaultDatabaseCredsPath,
-		},
-	)
+	vault, authToken, err := NewVaultAppRoleClient(ctx, env.vaultParameters())
 	if err != nil {
 		return fmt.Errorf("unable to initialize vault connection @ %s: %w", env.VaultAddress, err)
 	}
 
+	// the named secrets declared in the config file
+	if err := vault.LoadSecrets(ctx); err != nil {
+		return fmt.Errorf("unable to retrieve the declared secrets from vault: %w", err)
+	}
+
 	// database
 	databaseCredentials, databaseCredentialsLease, err := vault.GetDatabaseCredentials(ctx)
 	if err != nil {
 		return fmt.Errorf("unable to retrieve database credentials from vault: %w", err)
 	}
 
-	database, err := NewDatabase(
-		ctx,
-		DatabaseParameters{
-			hostname: env.DatabaseHostname,
-			port:     env.DatabasePort,
-			name:     env.DatabaseName,
-			timeout:  env.DatabaseTimeout,
-		},
-		databaseCredentials,
-	)
+	database, err := NewDatabase(ctx, env.databaseParameters(), databaseCredentials)
 	if err != nil {
 		return fmt.Errorf("unable to connect to database @ %s:%s: %w", env.DatabaseHostname, env.DatabasePort, err)
 	}
+
+	// Shutdown happens in the following order (the deferred functions below
+	// run in reverse order, after listenAndServe has returned):
+	//   1. stop accepting new connections & drain in-flight requests
+	//   2. stop the lease-renewal & other background goroutines
+	//   3. close the database connection & revoke its credentials
 	defer func() {
-		_ = database.Close()
+		log.Println("shutdown: closing the database connection")
+
+		if err := database.Close(); err != nil {
+			log.Printf("shutdown: unable to close the database connection: %v", err)
+		}
+
+		// the credentials may have been replaced by the renewal goroutine;
+		// use a fresh context since ctx is cancelled by now
+		revokeCtx, cancelRevokeFunc := context.WithTimeout(context.Background(), env.MyDrainTimeout)
+		defer cancelRevokeFunc()
+
+		if err := vault.RevokeLease(revokeCtx, databaseCredentialsLease); err != nil {
+			log.Printf("shutdown: database credentials: %v", err)
+		}
+
+		if err := vault.RevokeSecretLeases(revokeCtx); err != nil {
+			log.Printf("shutdown: declared secrets: %v", err)
+		}
 	}()
 
-	// start the lease-renewal goroutine & wait for it to finish on exit
+	// fetch new credentials right away if the database rejects the current ones
+	database.SetCredentialsRefreshFunc(vault.RequestDatabaseCredentialsRefresh)
+
+	// start the lease-renewal & secret refresh goroutines & wait for them to finish on exit
 	var wg sync.WaitGroup
-	wg.Add(1)
+	wg.Add(3)
 	go func() {
-		vault.PeriodicallyRenewLeases(ctx, authToken, databaseCredentialsLease, database.Reconnect)
+		databaseCredentialsLease = vault.PeriodicallyRenewLeases(ctx, authToken, databaseCredentialsLease, database.Reconnect)
+		wg.Done()
+	}()
+	go func() {
+		vault.PeriodicallyRefreshAPIKey(ctx)
+		wg.Done()
+	}()
+	go func() {
+		vault.PeriodicallyRefreshSecrets(ctx)
 		wg.Done()
 	}()
 	defer func() {
+		log.Println("shutdown: stopping background goroutines")
+
 		cancelContextFunc()
 		wg.Wait()
 	}()
 
+	// the way the api key is attached to the requests to the secure service
+	secureServiceAuth, err := ParseCredentialInjection(env.SecureServiceAuth)
+	if err != nil {
+		return fmt.Errorf("invalid secure service credential scheme: %w", err)
+	}
+
+	// optionally sign secure service requests with a transit key
+	secureServiceSigner, err := NewRequestSigner(vault, SigningMode(env.SecureServiceSigning), env.SecureServiceSigningKey)
+	if err != nil {
+		return fmt.Errorf("invalid secure service signing configuration: %w", err)
+	}
+
+	// webhook providers & the vault keys / secrets their signatures are verified with
+	webhookProviders, err := ParseWebhookProviders(env.WebhookProviders)
+	if err != nil {
+		return fmt.Errorf("invalid webhook providers: %w", err)
+	}
+
+	// additional requirements callers must meet to use some of our routes
+	routeRequirements, err := ParseCallerRequirements(env.AuthRoutes)
+	if err != nil {
+		return fmt.Errorf("invalid route requirements: %w", err)
+	}
+
+	// authenticate to the secure service with a client certificate issued by
+	// vault pki (re-issued in the background) instead of the api key
+	var secureServiceTLSConfig *tls.Config
+
+	if env.SecureServiceMTLS {
+		clientCertificate, err := vault.NewCertificate(ctx, env.clientCertificateParameters())
+		if err != nil {
+			return fmt.Errorf("unable to issue client certificate: %w", err)
+		}
+
+		rootCAs, err := vault.GetCACertificates(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to retrieve ca certificate from vault: %w", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			vault.PeriodicallyRenewCertificate(ctx, clientCertificate)
+			wg.Done()
+		}()
+
+		secureServiceTLSConfig = mutualTLSConfig(clientCertificate, rootCAs)
+	}
+
 	// handlers & routes
 	h := Handlers{
 		database:             database,
 		vault:                vault,
 		secureServiceAddress: env.SecureServiceAddress,
+		secureServiceClient:  NewSecureServiceClient(env.secureServiceClientParameters(), secureServiceTLSConfig),
+		secureServiceAuth:    secureServiceAuth,
+		secureServiceMTLS:    env.SecureServiceMTLS,
+		secureServiceSigner:  secureServiceSigner,
+		secureServiceTokens:  NewIdentityTokenSource(vault, env.SecureServiceIdentityTokenRole, env.SecureServiceIdentityTokenRefreshBefore),
+		transitKeys:          env.VaultTransitKeys,
+		webhooks:             NewWebhookVerifier(vault, webhookProviders, env.WebhookTolerance, env.WebhookKVMountPath, env.WebhookKVField, env.WebhookKVCacheTTL),
 	}
 
+	// the machine-readable contract of the routes below, which requests are validated against
+	openAPIDocument := newOpenAPIDocument()
+
+	// requests are only validated once the caller has been authenticated, so
+	// that anonymous callers cannot probe the api with malformed requests
+	validateOpenAPI := ValidateOpenAPI(openAPIDocument, env.OpenAPIValidateResponses)
+
 	r := gin.New()
 	r.Use(
 		gin.LoggerWithWriter(gin.DefaultWriter, "/healthcheck"), // don't log healthcheck requests
+		CorrelationID(),
 	)
 
+	public := r.Group("", validateOpenAPI)
+
 	// healthcheck
-	r.GET("/healthcheck", func(c *gin.Context) {
+	public.GET("/healthcheck", func(c *gin.Context) {
 		c.String(200, "OK")
 	})
 
+	// the openapi 3 document describing our api, e.g. to generate client sdks
+	public.GET("/openapi.json", ServeOpenAPI(openAPIDocument))
+
+	// demonstrates verifying webhook signatures with keys held in vault; webhooks
+	// are authenticated with their signatures rather than vault tokens
+	public.POST("/webhooks/:provider", h.ReceiveWebhook)
+
+	// all other endpoints require a vault token or a vault identity token
+	// (see CallerAuthenticator) meeting the requirements of the route, if any
+	authenticator := NewCallerAuthenticator(vault, env.AuthIdentityTokenIssuer, env.AuthIdentityTokenAudience)
+
+	api := r.Group("", AuthenticateCaller(authenticator, routeRequirements), validateOpenAPI)
+
 	// demonstrates fetching a static secret from vault and using it to talk to another service
-	r.POST("/payments", h.CreatePayment)
+	api.POST("/payments", h.CreatePayment)
 
 	// demonstrates database authentication with dynamic secrets
-	r.GET("/products", h.GetProducts)
+	api.GET("/products", h.GetProducts)
 
-	// http.ListenAndServe with graceful shutdown logic
-	endless.ListenAndServe(env.MyAddress, r)
+	// demonstrates encrypting sensitive data with the transit secrets engine before it is stored in the database
+	api.GET("/customers", h.GetCustomers)
+	api.GET("/customers/:id", h.GetCustomer)
+	api.POST("/customers", h.CreateCustomer)
 
-	return nil
+	// demonstrates encryption as a service with the transit secrets engine
+	api.POST("/encrypt", h.Encrypt)
+	api.POST("/decrypt", h.Decrypt)
+	api.POST("/rewrap", h.Rewrap)
+	api.POST("/rotate-key", RequireVaultPolicy(authenticator, env.VaultAdminPolicy), h.RotateKey)
+
+	// demonstrates managing the versions of a kv-v2 secret; only callers with
+	// a vault token which has the admin policy attached are allowed in
+	admin := api.Group("/admin", RequireVaultPolicy(authenticator, env.VaultAdminPolicy))
+	admin.GET("/api-key/versions", h.GetAPIKeyVersions)
+	admin.POST("/api-key/rollback", h.RollbackAPIKey)
+	admin.POST("/api-key/rotate", h.RotateAPIKey)
+
+	// catch typos in the route requirements, which would otherwise leave a route less protected than intended
+	if err := checkRouteRequirements(r.Routes(), routeRequirements); err != nil {
+		return err
+	}
+
+	// the openapi document must describe exactly the routes above
+	if err := openAPIDocument.checkRoutes(r.Routes()); err != nil {
+		return err
+	}
+
+	// https with a certificate issued by vault pki, which is re-issued & swapped in the background before it expires
+	var serverCertificate *Certificate
+
+	if env.MyTLS {
+		certificate, err := vault.NewCertificate(ctx, env.serverCertificateParameters())
+		if err != nil {
+			return fmt.Errorf("unable to issue server certificate: %w", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			vault.PeriodicallyRenewCertificate(ctx, certificate)
+			wg.Done()
+		}()
+
+		serverCertificate = certificate
+	}
+
+	// apply configuration changes which are safe to apply live on SIGHUP
+	reloader := NewConfigReloader(os.Args[1:], env, vault, &h)
+
+	wg.Add(1)
+	go func() {
+		reloader.ReloadOnSignal(ctx)
+		wg.Done()
+	}()
+
+	// blocks until SIGINT / SIGTERM, then drains in-flight requests
+	return listenAndServe(ctx, env.MyAddress, r, serverCertificate, env.MyDrainTimeout)
 }
@@ -0,0 +1,123 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const correlationIDHeader = "X-Request-ID"
+
+type correlationIDKey struct{}
+
+// CorrelationID makes sure every request has a correlation id: the incoming
+// X-Request-ID header is reused if present, otherwise a new id is generated.
+// The id is echoed in the response and stored in the request context, so that
+// it can be propagated to the services we call (see SecureServiceClient).
+func CorrelationID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(correlationIDHeader)
+		if id == "" {
+			id = newCorrelationID()
+		}
+
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), correlationIDKey{}, id))
+		c.Header(correlationIDHeader, id)
+
+		c.Next()
+	}
+}
+
+func correlationIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+func newCorrelationID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+const callerKey = "caller"
+
+// AuthenticateCaller only lets requests through if they carry a valid Vault
+// token or Vault identity token (see CallerAuthenticator) whose caller meets
+// the requirements configured for the matched route, if any
+func AuthenticateCaller(a *CallerAuthenticator, routeRequirements map[string]CallerRequirements) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requireCaller(c, a, routeRequirements[c.FullPath()])
+	}
+}
+
+// RequireCaller is like AuthenticateCaller, with the same requirements for
+// all routes it is used on
+func RequireCaller(a *CallerAuthenticator, requirements CallerRequirements) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requireCaller(c, a, requirements)
+	}
+}
+
+// RequireVaultPolicy only lets requests through if they carry a valid Vault
+// token which has the given policy attached
+func RequireVaultPolicy(a *CallerAuthenticator, policy string) gin.HandlerFunc {
+	return RequireCaller(a, CallerRequirements{Policies: []string{policy}})
+}
+
+func requireCaller(c *gin.Context, a *CallerAuthenticator, requirements CallerRequirements) {
+	// the caller may have been authenticated already by a previous middleware
+	caller, ok := callerFromContext(c)
+	if !ok {
+		var err error
+
+		caller, err = a.Authenticate(c.Request.Context(), c.Request)
+		switch {
+		case errors.Is(err, ErrCallerMissingToken):
+			abortWithError(c, http.StatusUnauthorized, errorCodeUnauthorized, "missing X-Vault-Token or Authorization header")
+			return
+		case errors.Is(err, ErrCallerInvalidToken):
+			log.Printf("caller authentication error: %v", err)
+			abortWithError(c, http.StatusUnauthorized, errorCodeUnauthorized, "invalid vault token or identity token")
+			return
+		case err != nil:
+			abortWithInternalError(c, err)
+			return
+		}
+
+		c.Set(callerKey, caller)
+	}
+
+	reason, err := a.Authorize(c.Request.Context(), caller, requirements)
+	if err != nil {
+		abortWithInternalError(c, err)
+		return
+	}
+
+	if reason != "" {
+		abortWithError(c, http.StatusForbidden, errorCodeForbidden, reason)
+		return
+	}
+
+	c.Next()
+}
+
+// callerFromContext returns the caller authenticated by AuthenticateCaller
+// or RequireCaller
+func callerFromContext(c *gin.Context) (*Caller, bool) {
+	value, ok := c.Get(callerKey)
+	if !ok {
+		return nil, false
+	}
+	caller, ok := value.(*Caller)
+	return caller, ok
+}
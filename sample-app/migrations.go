@@ -0,0 +1,248 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schema migrations are embedded into the binary and applied in order by the
+// 'migrate' command. Each file must be named "<version>_<name>.sql", e.g.
+// "0002_add_orders_table.sql"; applied migrations must never be modified.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationsLockID is an arbitrary (but fixed) key for the postgres advisory
+// lock which prevents concurrent 'migrate' runs from racing each other
+const migrationsLockID = 727_001
+
+// migrationsCredentialsSecret is the named secret (see SecretDefinition) the
+// 'migrate' command reads its database credentials from. Unless the config
+// file declares it, it is read from VAULT_DATABASE_MIGRATIONS_CREDS_PATH.
+const migrationsCredentialsSecret = "database-migrations-credentials"
+
+type Migration struct {
+	Version    int
+	Name       string
+	Statements string
+}
+
+// migrate applies all pending schema migrations. Unlike the web server, it
+// connects to the database with a short-lived privileged set of credentials
+// which are revoked as soon as the migrations are finished.
+func migrate(ctx context.Context, env Environment) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return fmt.Errorf("unable to load migrations: %w", err)
+	}
+
+	parameters, err := env.migrationsVaultParameters()
+	if err != nil {
+		return err
+	}
+
+	// vault
+	vault, _, err := NewVaultAppRoleClient(ctx, parameters)
+	if err != nil {
+		return fmt.Errorf("unable to initialize vault connection @ %s: %w", env.VaultAddress, err)
+	}
+
+	// privileged database credentials
+	secret, err := vault.Secret(ctx, migrationsCredentialsSecret)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve database migrations credentials from vault: %w", err)
+	}
+	defer func() {
+		// use a fresh context to revoke the credentials even if ctx is cancelled
+		if err := vault.RevokeSecretLeases(context.Background()); err != nil {
+			log.Printf("database migrations credentials: %v", err)
+		}
+	}()
+
+	var databaseCredentials DatabaseCredentials
+
+	if err := secret.Decode(&databaseCredentials); err != nil {
+		return err
+	}
+
+	// database
+	database, err := NewDatabase(ctx, env.databaseParameters(), databaseCredentials)
+	if err != nil {
+		return fmt.Errorf("unable to connect to database @ %s:%s: %w", env.DatabaseHostname, env.DatabasePort, err)
+	}
+	defer func() {
+		_ = database.Close()
+	}()
+
+	return database.Migrate(ctx, migrations)
+}
+
+// migrationsVaultParameters declares the migrations credentials secret, on
+// top of the ones declared in the config file
+func (env Environment) migrationsVaultParameters() (VaultParameters, error) {
+	parameters := env.vaultParameters()
+
+	if _, ok := env.Secrets[migrationsCredentialsSecret]; ok {
+		return parameters, nil
+	}
+
+	definition, err := databaseSecretDefinition(env.VaultDatabaseMigrationsCredsPath)
+	if err != nil {
+		return VaultParameters{}, err
+	}
+
+	parameters.secrets = make(map[string]SecretDefinition, len(env.Secrets)+1)
+	for name, d := range env.Secrets {
+		parameters.secrets[name] = d
+	}
+	parameters.secrets[migrationsCredentialsSecret] = definition
+
+	return parameters, nil
+}
+
+// loadMigrations parses the embedded migration files, sorted by version
+func loadMigrations() ([]Migration, error) {
+	paths, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(paths))
+	versions := make(map[int]string, len(paths))
+
+	for _, path := range paths {
+		file := strings.TrimSuffix(strings.TrimPrefix(path, "migrations/"), ".sql")
+
+		v, name, ok := strings.Cut(file, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %q is not named <version>_<name>.sql", path)
+		}
+
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("migration %q has an invalid version: %w", path, err)
+		}
+
+		if existing, ok := versions[version]; ok {
+			return nil, fmt.Errorf("migrations %q and %q have the same version", existing, path)
+		}
+		versions[version] = path
+
+		b, err := migrationFiles.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read migration %q: %w", path, err)
+		}
+
+		migrations = append(migrations, Migration{
+			Version:    version,
+			Name:       name,
+			Statements: string(b),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Migrate applies the given migrations which have not been applied yet. The
+// applied versions are recorded in the schema_migrations table, and a
+// postgres advisory lock guarantees that only one instance migrates at a time.
+// Each migration is applied in its own transaction.
+func (db *Database) Migrate(ctx context.Context, migrations []Migration) error {
+	/* */ db.connectionMutex.Lock()
+	defer db.connectionMutex.Unlock()
+
+	log.Println("applying database migrations")
+	defer log.Println("applying database migrations: done")
+
+	// advisory locks are held by a session, so we need a dedicated connection
+	connection, err := db.connection.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to acquire database connection: %w", err)
+	}
+	defer func() {
+		_ = connection.Close()
+	}()
+
+	if _, err := connection.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationsLockID); err != nil {
+		return fmt.Errorf("unable to acquire migrations lock: %w", err)
+	}
+	defer func() {
+		_, _ = connection.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationsLockID)
+	}()
+
+	const createTableQuery = `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version     integer      PRIMARY KEY,
+		name        TEXT         NOT NULL,
+		applied_at  timestamptz  NOT NULL  DEFAULT now()
+	)`
+
+	if _, err := connection.ExecContext(ctx, createTableQuery); err != nil {
+		return fmt.Errorf("unable to create schema_migrations table: %w", err)
+	}
+
+	const appliedQuery = "SELECT version FROM schema_migrations"
+
+	rows, err := connection.QueryContext(ctx, appliedQuery)
+	if err != nil {
+		return fmt.Errorf("failed to execute %q query: %w", appliedQuery, err)
+	}
+
+	applied := make(map[int]bool)
+
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed to scan table row for %q query: %w", appliedQuery, err)
+		}
+		applied[version] = true
+	}
+
+	if err := rows.Close(); err != nil {
+		return fmt.Errorf("error after scanning %q query: %w", appliedQuery, err)
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+
+		log.Printf("applying migration %04d_%s", m.Version, m.Name)
+
+		tx, err := connection.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("unable to begin transaction for migration %d: %w", m.Version, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, m.Statements); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration %04d_%s failed: %w", m.Version, m.Name, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("unable to record migration %d: %w", m.Version, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("unable to commit migration %d: %w", m.Version, err)
+		}
+
+		log.Printf("applying migration %04d_%s: success!", m.Version, m.Name)
+	}
+
+	return nil
+}
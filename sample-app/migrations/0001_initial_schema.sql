@@ -0,0 +1,20 @@
+-- Copyright (c) HashiCorp, Inc.
+-- SPDX-License-Identifier: MPL-2.0
+
+-- The initial schema mirrors docker-compose-setup/database/1-schema.sql so
+-- that environments created from the init scripts can be brought under
+-- migration control; every later migration should be a new file.
+
+CREATE TABLE IF NOT EXISTS products (
+   id          serial        PRIMARY KEY,
+   name        VARCHAR(255)  NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS customers (
+   id          serial        PRIMARY KEY,
+   first_name  VARCHAR(50)   NOT NULL,
+   last_name   VARCHAR(50)   NOT NULL,
+   email       TEXT          NOT NULL,
+   phone       VARCHAR(15)   NOT NULL,
+   address     TEXT          NOT NULL  DEFAULT ''
+);
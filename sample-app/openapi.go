@@ -0,0 +1,324 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAPIDocument is the subset of the OpenAPI 3 specification we need to
+// describe our API; see newOpenAPIDocument for the document itself
+type OpenAPIDocument struct {
+	OpenAPI    string                       `json:"openapi"`
+	Info       OpenAPIInfo                  `json:"info"`
+	Security   []OpenAPISecurityRequirement `json:"security,omitempty"`
+	Paths      map[string]OpenAPIPathItem   `json:"paths"`
+	Components OpenAPIComponents            `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// OpenAPISecurityRequirement maps security scheme names to their scopes
+type OpenAPISecurityRequirement map[string][]string
+
+// OpenAPIPathItem maps lower case http methods to operations
+type OpenAPIPathItem map[string]*OpenAPIOperation
+
+type OpenAPIOperation struct {
+	OperationID string                        `json:"operationId"`
+	Summary     string                        `json:"summary,omitempty"`
+	Tags        []string                      `json:"tags,omitempty"`
+	Security    *[]OpenAPISecurityRequirement `json:"security,omitempty"` // overrides the document's; empty means no authentication
+	Parameters  []OpenAPIParameter            `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody           `json:"requestBody,omitempty"`
+	Responses   map[string]OpenAPIResponse    `json:"responses"` // by status code, or "default"
+}
+
+type OpenAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"` // path, query or header
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *OpenAPISchema `json:"schema"`
+}
+
+type OpenAPIRequestBody struct {
+	Description string                      `json:"description,omitempty"`
+	Required    bool                        `json:"required,omitempty"`
+	Content     map[string]OpenAPIMediaType `json:"content"`
+}
+
+type OpenAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]OpenAPIMediaType `json:"content,omitempty"`
+}
+
+type OpenAPIMediaType struct {
+	Schema *OpenAPISchema `json:"schema,omitempty"` // not validated if nil
+}
+
+type OpenAPIComponents struct {
+	Schemas         map[string]*OpenAPISchema        `json:"schemas"`
+	SecuritySchemes map[string]OpenAPISecurityScheme `json:"securitySchemes"`
+}
+
+type OpenAPISecurityScheme struct {
+	Type         string `json:"type"`
+	Description  string `json:"description,omitempty"`
+	Name         string `json:"name,omitempty"`
+	In           string `json:"in,omitempty"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+}
+
+type OpenAPISchema struct {
+	Ref         string                    `json:"$ref,omitempty"`
+	Type        string                    `json:"type,omitempty"`
+	Format      string                    `json:"format,omitempty"`
+	Description string                    `json:"description,omitempty"`
+	Nullable    bool                      `json:"nullable,omitempty"`
+	Enum        []string                  `json:"enum,omitempty"`
+	MinLength   *int                      `json:"minLength,omitempty"`
+	MaxLength   *int                      `json:"maxLength,omitempty"`
+	Minimum     *float64                  `json:"minimum,omitempty"`
+	Maximum     *float64                  `json:"maximum,omitempty"`
+	MinItems    *int                      `json:"minItems,omitempty"`
+	MaxItems    *int                      `json:"maxItems,omitempty"`
+	Properties  map[string]*OpenAPISchema `json:"properties,omitempty"`
+	Required    []string                  `json:"required,omitempty"`
+	Items       *OpenAPISchema            `json:"items,omitempty"`
+}
+
+const openAPISchemaRefPrefix = "#/components/schemas/"
+
+// add registers the operation of the given gin route (e.g. "/customers/:id")
+func (d *OpenAPIDocument) add(method, ginPath string, operation *OpenAPIOperation) {
+	path := openAPIPath(ginPath)
+
+	if d.Paths[path] == nil {
+		d.Paths[path] = make(OpenAPIPathItem)
+	}
+
+	d.Paths[path][strings.ToLower(method)] = operation
+}
+
+// operation returns the operation of the given gin route, or nil
+func (d *OpenAPIDocument) operation(method, ginPath string) *OpenAPIOperation {
+	return d.Paths[openAPIPath(ginPath)][strings.ToLower(method)]
+}
+
+// openAPIPath converts gin path parameters (":id", "*path") to OpenAPI ones ("{id}")
+func openAPIPath(ginPath string) string {
+	segments := strings.Split(ginPath, "/")
+
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// checkRoutes makes sure that the document describes exactly the routes
+// registered with gin, so that the two cannot drift apart
+func (d *OpenAPIDocument) checkRoutes(routes gin.RoutesInfo) error {
+	var problems []string
+
+	registered := make(map[string]bool, len(routes))
+
+	for _, route := range routes {
+		registered[route.Method+" "+openAPIPath(route.Path)] = true
+
+		if d.operation(route.Method, route.Path) == nil {
+			problems = append(problems, fmt.Sprintf("%s %s is not documented", route.Method, route.Path))
+		}
+	}
+
+	for path, item := range d.Paths {
+		for method := range item {
+			if !registered[strings.ToUpper(method)+" "+path] {
+				problems = append(problems, fmt.Sprintf("%s %s is documented but not registered", strings.ToUpper(method), path))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("the openapi document does not match the routes: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// schemaRef registers the schema of the given Go type in the document's
+// components (by type name) and returns a reference to it. The schema is
+// derived from the type's json & gin binding tags, so it stays in sync with
+// what the handlers actually accept & return.
+func (d *OpenAPIDocument) schemaRef(t reflect.Type) *OpenAPISchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct || t.Name() == "" || t == reflect.TypeOf(time.Time{}) {
+		return d.schemaOf(t)
+	}
+
+	if _, ok := d.Components.Schemas[t.Name()]; !ok {
+		d.Components.Schemas[t.Name()] = &OpenAPISchema{} // placeholder, in case the type refers to itself
+		d.Components.Schemas[t.Name()] = d.objectSchemaOf(t)
+	}
+
+	return &OpenAPISchema{Ref: openAPISchemaRefPrefix + t.Name()}
+}
+
+func (d *OpenAPIDocument) schemaOf(t reflect.Type) *OpenAPISchema {
+	if t == reflect.TypeOf(time.Time{}) {
+		return &OpenAPISchema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := d.schemaOf(t.Elem())
+		if schema.Ref == "" {
+			schema.Nullable = true
+		}
+		return schema
+	case reflect.Struct:
+		if t.Name() == "" {
+			return d.objectSchemaOf(t)
+		}
+		return d.schemaRef(t)
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &OpenAPISchema{Type: "string", Format: "byte"}
+		}
+		return &OpenAPISchema{Type: "array", Items: d.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &OpenAPISchema{Type: "object"}
+	case reflect.String:
+		return &OpenAPISchema{Type: "string"}
+	case reflect.Bool:
+		return &OpenAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &OpenAPISchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &OpenAPISchema{Type: "number"}
+	}
+
+	return &OpenAPISchema{} // any value
+}
+
+func (d *OpenAPIDocument) objectSchemaOf(t reflect.Type) *OpenAPISchema {
+	schema := &OpenAPISchema{
+		Type:       "object",
+		Properties: make(map[string]*OpenAPISchema),
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+
+		// the fields of embedded structs are promoted, like encoding/json does
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := d.objectSchemaOf(field.Type)
+			for n, s := range embedded.Properties {
+				if _, ok := schema.Properties[n]; !ok {
+					schema.Properties[n] = s
+				}
+			}
+			schema.Required = append(schema.Required, embedded.Required...)
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		property := d.schemaOf(field.Type)
+
+		for _, rule := range strings.Split(field.Tag.Get("binding"), ",") {
+			if rule == "required" {
+				schema.Required = append(schema.Required, name)
+				continue
+			}
+
+			if bound, value, ok := strings.Cut(rule, "="); ok && (bound == "min" || bound == "max") && property.Ref == "" {
+				applyBindingBound(property, bound, value)
+			}
+		}
+
+		schema.Properties[name] = property
+	}
+
+	return schema
+}
+
+// applyBindingBound translates a "min=<n>" or "max=<n>" binding rule, which
+// the validator applies to the length of strings & arrays and to the value of
+// numbers, to the matching schema keyword
+func applyBindingBound(property *OpenAPISchema, bound, value string) {
+	switch property.Type {
+	case "string", "array":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return
+		}
+
+		switch {
+		case property.Type == "string" && bound == "min":
+			property.MinLength = &n
+		case property.Type == "string":
+			property.MaxLength = &n
+		case bound == "min":
+			property.MinItems = &n
+		default:
+			property.MaxItems = &n
+		}
+
+	case "integer", "number":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return
+		}
+
+		if bound == "min" {
+			property.Minimum = &f
+		} else {
+			property.Maximum = &f
+		}
+	}
+}
+
+// resolve follows a reference to the components' schemas
+func (d *OpenAPIDocument) resolve(schema *OpenAPISchema) *OpenAPISchema {
+	for schema != nil && schema.Ref != "" {
+		schema = d.Components.Schemas[strings.TrimPrefix(schema.Ref, openAPISchemaRefPrefix)]
+	}
+	return schema
+}
+
+// ServeOpenAPI serves the document as json
+func ServeOpenAPI(d *OpenAPIDocument) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, d)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+)
+
+// newOpenAPIDocument describes every route registered in run; checkRoutes
+// fails at startup if a route is added without being described here (or the
+// other way around). The request & response schemas are derived from the
+// types the handlers bind & return.
+func newOpenAPIDocument() *OpenAPIDocument {
+	d := &OpenAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: OpenAPIInfo{
+			Title:       "hello-vault-go",
+			Description: "A sample web service which uses HashiCorp Vault for its secrets, encryption & authentication",
+			Version:     "1.0.0",
+		},
+		Security: []OpenAPISecurityRequirement{
+			{"vaultToken": {}},
+			{"bearerToken": {}},
+		},
+		Paths: make(map[string]OpenAPIPathItem),
+		Components: OpenAPIComponents{
+			Schemas: make(map[string]*OpenAPISchema),
+			SecuritySchemes: map[string]OpenAPISecurityScheme{
+				"vaultToken": {
+					Type:        "apiKey",
+					Description: "A Vault token",
+					Name:        "X-Vault-Token",
+					In:          "header",
+				},
+				"bearerToken": {
+					Type:         "http",
+					Description:  "A Vault token or a Vault identity token",
+					Scheme:       "bearer",
+					BearerFormat: "JWT",
+				},
+			},
+		},
+	}
+
+	var (
+		public      = &[]OpenAPISecurityRequirement{}
+		adminPolicy = "Requires a Vault token with the admin policy attached"
+	)
+
+	errorResponse := OpenAPIResponse{
+		Description: "Error",
+		Content:     jsonContent(d.schemaRef(reflect.TypeOf(ErrorResponse{}))),
+	}
+
+	ok := func(description string, v interface{}) map[string]OpenAPIResponse {
+		return map[string]OpenAPIResponse{
+			"200":     {Description: description, Content: jsonContent(d.schemaOf(reflect.TypeOf(v)))},
+			"default": errorResponse,
+		}
+	}
+
+	jsonBody := func(v interface{}) *OpenAPIRequestBody {
+		return &OpenAPIRequestBody{
+			Required: true,
+			Content:  jsonContent(d.schemaOf(reflect.TypeOf(v))),
+		}
+	}
+
+	// healthcheck & documentation
+	d.add(http.MethodGet, "/healthcheck", &OpenAPIOperation{
+		OperationID: "healthcheck",
+		Summary:     "Reports whether the service is up",
+		Tags:        []string{"meta"},
+		Security:    public,
+		Responses: map[string]OpenAPIResponse{
+			"200": {Description: "The service is up", Content: map[string]OpenAPIMediaType{"text/plain": {Schema: &OpenAPISchema{Type: "string"}}}},
+		},
+	})
+
+	d.add(http.MethodGet, "/openapi.json", &OpenAPIOperation{
+		OperationID: "getOpenAPIDocument",
+		Summary:     "Returns this document",
+		Tags:        []string{"meta"},
+		Security:    public,
+		Responses: map[string]OpenAPIResponse{
+			"200": {Description: "The OpenAPI document", Content: jsonContent(&OpenAPISchema{Type: "object"})},
+		},
+	})
+
+	// static secrets
+	idempotencyKeyMaxLength := 255
+
+	d.add(http.MethodPost, "/payments", &OpenAPIOperation{
+		OperationID: "createPayment",
+		Summary:     "Forwards a payment to the secure service, authenticated with credentials from Vault",
+		Tags:        []string{"payments"},
+		Parameters: []OpenAPIParameter{
+			{
+				Name:        "Idempotency-Key",
+				In:          "header",
+				Description: "Lets the secure service recognize (and the service safely retry) the same payment",
+				Schema:      &OpenAPISchema{Type: "string", MaxLength: &idempotencyKeyMaxLength},
+			},
+		},
+		RequestBody: &OpenAPIRequestBody{
+			Description: "Passed on to the secure service as is",
+			Content: map[string]OpenAPIMediaType{
+				"application/json": {Schema: &OpenAPISchema{Type: "object"}},
+				"*/*":              {},
+			},
+		},
+		Responses: map[string]OpenAPIResponse{
+			"default": {Description: "The secure service's response, or an error", Content: map[string]OpenAPIMediaType{"*/*": {}}},
+		},
+	})
+
+	// dynamic secrets
+	d.add(http.MethodGet, "/products", &OpenAPIOperation{
+		OperationID: "listProducts",
+		Summary:     "Lists products, read with dynamic database credentials",
+		Tags:        []string{"products"},
+		Responses:   ok("The products", []Product{}),
+	})
+
+	// encryption of customer data
+	customerID := OpenAPIParameter{Name: "id", In: "path", Required: true, Schema: &OpenAPISchema{Type: "integer"}}
+
+	d.add(http.MethodGet, "/customers", &OpenAPIOperation{
+		OperationID: "listCustomers",
+		Summary:     "Lists customers, decrypting their sensitive fields with Vault transit",
+		Tags:        []string{"customers"},
+		Responses:   ok("The customers", []Customer{}),
+	})
+
+	d.add(http.MethodGet, "/customers/:id", &OpenAPIOperation{
+		OperationID: "getCustomer",
+		Summary:     "Returns a customer, decrypting their sensitive fields with Vault transit",
+		Tags:        []string{"customers"},
+		Parameters:  []OpenAPIParameter{customerID},
+		Responses:   ok("The customer", Customer{}),
+	})
+
+	d.add(http.MethodPost, "/customers", &OpenAPIOperation{
+		OperationID: "createCustomer",
+		Summary:     "Creates a customer, encrypting their sensitive fields with Vault transit",
+		Tags:        []string{"customers"},
+		RequestBody: jsonBody(Customer{}),
+		Responses: map[string]OpenAPIResponse{
+			"201":     {Description: "The created customer", Content: jsonContent(d.schemaRef(reflect.TypeOf(Customer{})))},
+			"default": errorResponse,
+		},
+	})
+
+	// encryption as a service
+	for _, operation := range []struct{ path, id, summary string }{
+		{"/encrypt", "encrypt", "Encrypts base64 plaintext (or a batch) with an allowed transit key"},
+		{"/decrypt", "decrypt", "Decrypts a ciphertext (or a batch) with an allowed transit key"},
+		{"/rewrap", "rewrap", "Re-encrypts a ciphertext (or a batch) with the latest or given key version"},
+	} {
+		d.add(http.MethodPost, operation.path, &OpenAPIOperation{
+			OperationID: operation.id,
+			Summary:     operation.summary,
+			Tags:        []string{"transit"},
+			RequestBody: jsonBody(TransitRequest{}),
+			Responses:   ok("The result, or batch_results for a batch_input", TransitResponse{}),
+		})
+	}
+
+	d.add(http.MethodPost, "/rotate-key", &OpenAPIOperation{
+		OperationID: "rotateKey",
+		Summary:     "Rotates an allowed transit key. " + adminPolicy,
+		Tags:        []string{"transit", "admin"},
+		RequestBody: jsonBody(TransitRotateKeyRequest{}),
+		Responses:   ok("The new latest version of the key", TransitRotateKeyResponse{}),
+	})
+
+	// webhooks
+	d.add(http.MethodPost, "/webhooks/:provider", &OpenAPIOperation{
+		OperationID: "receiveWebhook",
+		Summary:     "Receives a webhook after verifying its signature with a key held in Vault",
+		Tags:        []string{"webhooks"},
+		Security:    public, // authenticated by their signature
+		Parameters: []OpenAPIParameter{
+			{Name: "provider", In: "path", Required: true, Schema: &OpenAPISchema{Type: "string"}},
+			{Name: signatureHeader, In: "header", Required: true, Schema: &OpenAPISchema{Type: "string"}},
+			{Name: signatureTimestampHeader, In: "header", Required: true, Description: "Unix seconds", Schema: &OpenAPISchema{Type: "integer"}},
+			{Name: webhookNonceHeader, In: "header", Required: true, Schema: &OpenAPISchema{Type: "string"}},
+		},
+		RequestBody: &OpenAPIRequestBody{
+			Content: map[string]OpenAPIMediaType{"*/*": {}},
+		},
+		Responses: map[string]OpenAPIResponse{
+			"202":     {Description: "The webhook was accepted"},
+			"default": errorResponse,
+		},
+	})
+
+	// secret versions
+	d.add(http.MethodGet, "/admin/api-key/versions", &OpenAPIOperation{
+		OperationID: "listAPIKeyVersions",
+		Summary:     "Lists the versions & metadata of the API key stored in kv-v2. " + adminPolicy,
+		Tags:        []string{"admin"},
+		Responses:   ok("The versions of the API key", APIKeyVersions{}),
+	})
+
+	d.add(http.MethodPost, "/admin/api-key/rollback", &OpenAPIOperation{
+		OperationID: "rollbackAPIKey",
+		Summary:     "Rolls the API key back to an earlier version. " + adminPolicy,
+		Tags:        []string{"admin"},
+		RequestBody: jsonBody(RollbackAPIKeyRequest{}),
+		Responses:   ok("The new current version of the API key", APIKeyVersionResponse{}),
+	})
+
+	d.add(http.MethodPost, "/admin/api-key/rotate", &OpenAPIOperation{
+		OperationID: "rotateAPIKey",
+		Summary:     "Writes a new random API key (check-and-set). " + adminPolicy,
+		Tags:        []string{"admin"},
+		Responses:   ok("The new current version of the API key", APIKeyVersionResponse{}),
+	})
+
+	return d
+}
+
+func jsonContent(schema *OpenAPISchema) map[string]OpenAPIMediaType {
+	return map[string]OpenAPIMediaType{
+		"application/json": {Schema: schema},
+	}
+}
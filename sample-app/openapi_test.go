@@ -0,0 +1,73 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testBoundedRequest struct {
+	Name    string   `json:"name"    binding:"required,min=2,max=5"`
+	Version int      `json:"version" binding:"min=1,max=10"`
+	Tags    []string `json:"tags"    binding:"min=1,max=2"`
+}
+
+func TestOpenAPIBindingBounds(t *testing.T) {
+	d := newOpenAPIDocument()
+
+	schema := d.resolve(d.schemaRef(reflect.TypeOf(testBoundedRequest{})))
+
+	name, version, tags := schema.Properties["name"], schema.Properties["version"], schema.Properties["tags"]
+
+	if name.MinLength == nil || *name.MinLength != 2 || name.MaxLength == nil || *name.MaxLength != 5 || name.Minimum != nil {
+		t.Errorf("expected the string bounds to be lengths, got %+v", name)
+	}
+
+	if version.Minimum == nil || *version.Minimum != 1 || version.Maximum == nil || *version.Maximum != 10 || version.MinLength != nil {
+		t.Errorf("expected the integer bounds to be values, got %+v", version)
+	}
+
+	if tags.MinItems == nil || *tags.MinItems != 1 || tags.MaxItems == nil || *tags.MaxItems != 2 || tags.Minimum != nil {
+		t.Errorf("expected the array bounds to be item counts, got %+v", tags)
+	}
+
+	tests := []struct {
+		body    string
+		wantErr string
+	}{
+		{`{"name": "ab", "version": 1, "tags": ["a"]}`, ""},
+		{`{"name": "a", "version": 1, "tags": ["a"]}`, "must be at least 2 characters long"},
+		{`{"name": "abcdef", "version": 1, "tags": ["a"]}`, "must not be longer than 5 characters"},
+		{`{"name": "ab", "version": 0, "tags": ["a"]}`, "must be at least 1"},
+		{`{"name": "ab", "version": 11, "tags": ["a"]}`, "must be at most 10"},
+		{`{"name": "ab", "version": 1, "tags": []}`, "must have at least 1 items"},
+		{`{"name": "ab", "version": 1, "tags": ["a", "b", "c"]}`, "must not have more than 2 items"},
+	}
+
+	for _, tt := range tests {
+		decoder := json.NewDecoder(strings.NewReader(tt.body))
+		decoder.UseNumber()
+
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			t.Fatal(err)
+		}
+
+		err := d.validateValue(schema, value, "body")
+
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.body, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.body, tt.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxValidatedBodySize limits how much of a request or response body is
+// buffered to be validated
+const maxValidatedBodySize = 1 << 20
+
+// ValidateOpenAPI validates the incoming requests against the operation of
+// the matched route in the document: parameters & json bodies which don't
+// match are rejected with 400. With validateResponses, the responses are
+// checked as well, and mismatches are logged (the response is already on its
+// way to the caller by then).
+func ValidateOpenAPI(d *OpenAPIDocument, validateResponses bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		operation := d.operation(c.Request.Method, c.FullPath())
+		if operation == nil {
+			c.Next() // unknown route
+			return
+		}
+
+		if err := d.validateRequest(c, operation); err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				abortWithError(c, http.StatusRequestEntityTooLarge, errorCodeRequestTooLarge, fmt.Sprintf("request body must not be larger than %d bytes", maxValidatedBodySize))
+				return
+			}
+			abortWithError(c, http.StatusBadRequest, errorCodeInvalidRequest, err.Error())
+			return
+		}
+
+		if !validateResponses {
+			c.Next()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+
+		c.Next()
+
+		if err := d.validateResponse(operation, recorder.Status(), recorder.Header().Get("Content-Type"), recorder.body.Bytes(), recorder.truncated); err != nil {
+			log.Printf("openapi: %s %s: the response does not match the specification: %v", c.Request.Method, c.FullPath(), err)
+		}
+	}
+}
+
+func (d *OpenAPIDocument) validateRequest(c *gin.Context, operation *OpenAPIOperation) error {
+	for _, parameter := range operation.Parameters {
+		var (
+			value   string
+			present bool
+		)
+
+		switch parameter.In {
+		case "path":
+			value = c.Param(parameter.Name)
+			present = value != ""
+		case "query":
+			value, present = c.GetQuery(parameter.Name)
+		case "header":
+			value = c.GetHeader(parameter.Name)
+			present = value != ""
+		}
+
+		if !present {
+			if parameter.Required {
+				return fmt.Errorf("missing required %s parameter %q", parameter.In, parameter.Name)
+			}
+			continue
+		}
+
+		if err := d.validateParameter(parameter, value); err != nil {
+			return err
+		}
+	}
+
+	if operation.RequestBody == nil {
+		return nil
+	}
+
+	// our handlers bind json regardless of the declared content type, so
+	// undeclared content types are validated as json
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+
+	content, ok := operation.RequestBody.Content[mediaType]
+	if !ok {
+		content, ok = operation.RequestBody.Content["*/*"]
+	}
+	if !ok {
+		content = operation.RequestBody.Content["application/json"]
+	}
+
+	if content.Schema == nil {
+		return nil // the body is not validated, e.g. it is passed on as is
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxValidatedBodySize))
+	if err != nil {
+		return err
+	}
+
+	// the handler gets to read the body as well
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		if operation.RequestBody.Required {
+			return fmt.Errorf("the request body is required")
+		}
+		return nil
+	}
+
+	value, err := decodeJSONValue(body)
+	if err != nil {
+		return fmt.Errorf("the request body is not valid json: %v", err)
+	}
+
+	return d.validateValue(content.Schema, value, "body")
+}
+
+func (d *OpenAPIDocument) validateParameter(parameter OpenAPIParameter, raw string) error {
+	schema := d.resolve(parameter.Schema)
+	if schema == nil {
+		return nil
+	}
+
+	var value interface{} = raw
+
+	switch schema.Type {
+	case "integer":
+		if _, err := strconv.ParseInt(raw, 10, 64); err != nil {
+			return fmt.Errorf("%s parameter %q must be an integer", parameter.In, parameter.Name)
+		}
+		value = json.Number(raw)
+	case "number":
+		if _, err := strconv.ParseFloat(raw, 64); err != nil {
+			return fmt.Errorf("%s parameter %q must be a number", parameter.In, parameter.Name)
+		}
+		value = json.Number(raw)
+	case "boolean":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s parameter %q must be a boolean", parameter.In, parameter.Name)
+		}
+		value = b
+	}
+
+	return d.validateValue(schema, value, fmt.Sprintf("%s parameter %q", parameter.In, parameter.Name))
+}
+
+func (d *OpenAPIDocument) validateResponse(operation *OpenAPIOperation, status int, contentType string, body []byte, truncated bool) error {
+	response, ok := operation.Responses[strconv.Itoa(status)]
+	if !ok {
+		response, ok = operation.Responses["default"]
+	}
+	if !ok {
+		return fmt.Errorf("undocumented status %d", status)
+	}
+
+	if len(response.Content) == 0 || len(body) == 0 {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	content, ok := response.Content[mediaType]
+	if !ok {
+		content, ok = response.Content["*/*"]
+	}
+	if !ok {
+		return fmt.Errorf("undocumented content type %q for status %d", contentType, status)
+	}
+
+	if content.Schema == nil || truncated {
+		return nil
+	}
+
+	value, err := decodeJSONValue(body)
+	if err != nil {
+		return fmt.Errorf("the response body is not valid json: %v", err)
+	}
+
+	return d.validateValue(content.Schema, value, "response")
+}
+
+// decodeJSONValue decodes numbers as json.Number, so that integers can be
+// told apart from other numbers
+func decodeJSONValue(b []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the json value")
+	}
+
+	return value, nil
+}
+
+// validateValue validates a decoded json value against the schema; path
+// describes the value in error messages
+func (d *OpenAPIDocument) validateValue(schema *OpenAPISchema, value interface{}, path string) error {
+	schema = d.resolve(schema)
+	if schema == nil || schema.Type == "" {
+		return nil // any value
+	}
+
+	if value == nil {
+		if schema.Nullable {
+			return nil
+		}
+		return fmt.Errorf("%s must not be null", path)
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", path)
+		}
+
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				return fmt.Errorf("%s.%s is required", path, name)
+			}
+		}
+
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if property, ok := schema.Properties[name]; ok {
+				if err := d.validateValue(property, object[name], path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+
+	case "array":
+		list, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", path)
+		}
+
+		if schema.MinItems != nil && len(list) < *schema.MinItems {
+			return fmt.Errorf("%s must have at least %d items", path, *schema.MinItems)
+		}
+		if schema.MaxItems != nil && len(list) > *schema.MaxItems {
+			return fmt.Errorf("%s must not have more than %d items", path, *schema.MaxItems)
+		}
+
+		for i, item := range list {
+			if err := d.validateValue(schema.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", path)
+		}
+
+		length := utf8.RuneCountInString(s)
+
+		if schema.MinLength != nil && length < *schema.MinLength {
+			return fmt.Errorf("%s must be at least %d characters long", path, *schema.MinLength)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			return fmt.Errorf("%s must not be longer than %d characters", path, *schema.MaxLength)
+		}
+		if len(schema.Enum) > 0 && !containsAny(schema.Enum, s) {
+			return fmt.Errorf("%s must be one of %v", path, schema.Enum)
+		}
+		if schema.Format == "byte" {
+			if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+				return fmt.Errorf("%s must be base64-encoded", path)
+			}
+		}
+
+	case "integer", "number":
+		n, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s must be a %s", path, schema.Type)
+		}
+
+		if schema.Type == "integer" {
+			if _, err := n.Int64(); err != nil {
+				return fmt.Errorf("%s must be an integer", path)
+			}
+		}
+
+		f, err := n.Float64()
+		if err != nil {
+			return fmt.Errorf("%s must be a number", path)
+		}
+		if schema.Minimum != nil && f < *schema.Minimum {
+			return fmt.Errorf("%s must be at least %v", path, *schema.Minimum)
+		}
+		if schema.Maximum != nil && f > *schema.Maximum {
+			return fmt.Errorf("%s must be at most %v", path, *schema.Maximum)
+		}
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", path)
+		}
+	}
+
+	return nil
+}
+
+// responseRecorder keeps a copy of (the beginning of) the response body, so
+// that it can be validated once the handler is done
+type responseRecorder struct {
+	gin.ResponseWriter
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.record(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.record([]byte(s))
+	return r.ResponseWriter.WriteString(s)
+}
+
+func (r *responseRecorder) record(b []byte) {
+	if r.truncated {
+		return
+	}
+	if r.body.Len()+len(b) > maxValidatedBodySize {
+		r.truncated = true
+		return
+	}
+	r.body.Write(b)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CredentialScheme describes how a secret from Vault is attached to the
+// requests we send to another service
+type CredentialScheme string
+
+const (
+	CredentialSchemeHeader CredentialScheme = "header" // <name>: <api key>
+	CredentialSchemeBearer CredentialScheme = "bearer" // Authorization: Bearer <api key>
+	CredentialSchemeBasic  CredentialScheme = "basic"  // Authorization: Basic base64(<username>:<api key>)
+	CredentialSchemeQuery  CredentialScheme = "query"  // ?<name>=<api key>
+)
+
+// CredentialInjection is the credential scheme configured for the secure
+// service
+type CredentialInjection struct {
+	scheme CredentialScheme
+	name   string // the header name (header), query parameter name (query) or username field (basic)
+}
+
+// NewCredentialInjection validates the given scheme & name
+func NewCredentialInjection(scheme CredentialScheme, name string) (CredentialInjection, error) {
+	switch scheme {
+	case CredentialSchemeHeader, CredentialSchemeQuery, CredentialSchemeBasic:
+		if name == "" {
+			return CredentialInjection{}, fmt.Errorf("credential scheme %q requires a name", scheme)
+		}
+	case CredentialSchemeBearer:
+	default:
+		return CredentialInjection{}, fmt.Errorf("unknown credential scheme %q", scheme)
+	}
+
+	return CredentialInjection{
+		scheme: scheme,
+		name:   name,
+	}, nil
+}
+
+// ParseCredentialInjection parses a credential scheme of the form
+// "<scheme>[:<name>]", e.g. "header:X-API-KEY", "bearer" or "basic:username"
+// (the username field of the api key secret)
+func ParseCredentialInjection(definition string) (CredentialInjection, error) {
+	scheme, name, _ := strings.Cut(strings.TrimSpace(definition), ":")
+
+	injection, err := NewCredentialInjection(CredentialScheme(scheme), name)
+	if err != nil {
+		return CredentialInjection{}, fmt.Errorf("invalid credential scheme %q: %w", definition, err)
+	}
+
+	return injection, nil
+}
+
+// Inject attaches the given api key to the request. Basic authentication also
+// requires the username (read from a separate field of the same kv secret
+// version).
+func (i CredentialInjection) Inject(request *http.Request, apiKey APIKey) error {
+	switch i.scheme {
+	case CredentialSchemeHeader:
+		request.Header.Set(i.name, apiKey.Value)
+
+	case CredentialSchemeBearer:
+		request.Header.Set("Authorization", "Bearer "+apiKey.Value)
+
+	case CredentialSchemeBasic:
+		username, err := secretStringField(apiKey.fields, i.name)
+		if err != nil {
+			return fmt.Errorf("credential scheme %q requires a username: %w", i.scheme, err)
+		}
+		request.SetBasicAuth(username, apiKey.Value)
+
+	case CredentialSchemeQuery:
+		query := request.URL.Query()
+		query.Set(i.name, apiKey.Value)
+		request.URL.RawQuery = query.Encode()
+
+	default:
+		return fmt.Errorf("unknown credential scheme %q", i.scheme)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdentityTokenSource provides the Vault identity token we present to the
+// secure service instead of the shared api key. The token (a JWT signed by
+// Vault) identifies this app's entity; the secure service verifies it with
+// the public keys Vault publishes at identity/oidc/.well-known/keys.
+//
+// The token is minted from identity/oidc/token/<role> and cached until
+// shortly before it expires, so that Vault is not called on every request.
+type IdentityTokenSource struct {
+	vault         *Vault
+	role          string
+	refreshBefore time.Duration // how long before its expiry a token is replaced
+
+	mutex     sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// NewIdentityTokenSource returns nil if role is empty
+func NewIdentityTokenSource(v *Vault, role string, refreshBefore time.Duration) *IdentityTokenSource {
+	if role == "" {
+		return nil
+	}
+
+	return &IdentityTokenSource{
+		vault:         v,
+		role:          role,
+		refreshBefore: refreshBefore,
+	}
+}
+
+// Token returns the cached identity token, or mints a new one if it is
+// about to expire. Concurrent callers wait for a single token to be minted.
+func (s *IdentityTokenSource) Token(ctx context.Context) (string, error) {
+	/* */ s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token != "" && time.Until(s.expiresAt) > s.refreshBefore {
+		return s.token, nil
+	}
+
+	token, expiresAt, err := s.vault.MintIdentityToken(ctx, s.role)
+	if err != nil {
+		return "", err
+	}
+
+	s.token = token
+	s.expiresAt = expiresAt
+
+	return token, nil
+}
+
+// Invalidate drops the cached token, e.g. after the secure service rejected
+// it, so that the next request mints a new one
+func (s *IdentityTokenSource) Invalidate() {
+	/* */ s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.token = ""
+}
+
+// Inject adds the identity token to the request as a bearer token
+func (s *IdentityTokenSource) Inject(ctx context.Context, request *http.Request) error {
+	token, err := s.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get identity token: %w", err)
+	}
+
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	return nil
+}
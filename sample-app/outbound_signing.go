@@ -0,0 +1,119 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SigningMode describes how outbound requests are signed with a transit key
+type SigningMode string
+
+const (
+	SigningModeNone SigningMode = "none"
+	SigningModeHMAC SigningMode = "hmac" // symmetric: transit/hmac/<key>
+	SigningModeSign SigningMode = "sign" // asymmetric: transit/sign/<key>
+)
+
+const (
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureModeHeader      = "X-Signature-Mode"
+)
+
+// RequestSigner signs outbound requests with a transit key, so that the
+// receiving service can authenticate them without us sending a shared secret
+// over the wire. The signature covers the canonical form of the request (see
+// canonicalRequest) and is added to the X-Signature header along with the
+// X-Signature-Timestamp & X-Signature-Mode headers.
+type RequestSigner struct {
+	vault   *Vault
+	mode    SigningMode
+	keyName string
+}
+
+// NewRequestSigner returns nil if signing is disabled
+func NewRequestSigner(v *Vault, mode SigningMode, keyName string) (*RequestSigner, error) {
+	switch mode {
+	case SigningModeNone, "":
+		return nil, nil
+	case SigningModeHMAC, SigningModeSign:
+	default:
+		return nil, fmt.Errorf("unknown signing mode %q", mode)
+	}
+
+	if keyName == "" {
+		return nil, fmt.Errorf("signing mode %q requires a transit key", mode)
+	}
+
+	return &RequestSigner{
+		vault:   v,
+		mode:    mode,
+		keyName: keyName,
+	}, nil
+}
+
+// Sign adds the signature headers to the given request; body must be the
+// exact request body which is going to be sent
+func (s *RequestSigner) Sign(ctx context.Context, request *http.Request, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	canonical := canonicalRequest(request, timestamp, body)
+
+	var (
+		signature string
+		err       error
+	)
+
+	switch s.mode {
+	case SigningModeHMAC:
+		signature, err = s.vault.TransitHMAC(ctx, s.keyName, canonical)
+	case SigningModeSign:
+		signature, err = s.vault.TransitSign(ctx, s.keyName, canonical)
+	default:
+		err = fmt.Errorf("unknown signing mode %q", s.mode)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to sign request: %w", err)
+	}
+
+	request.Header.Set(signatureHeader, signature)
+	request.Header.Set(signatureTimestampHeader, timestamp)
+	request.Header.Set(signatureModeHeader, string(s.mode))
+
+	return nil
+}
+
+// canonicalRequest is what gets signed; the receiving service must build the
+// exact same string from the request it receives:
+//
+//	METHOD\n
+//	PATH[?QUERY]\n
+//	TIMESTAMP\n
+//	HEX(SHA256(BODY))
+func canonicalRequest(request *http.Request, timestamp string, body []byte) []byte {
+	path := request.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if request.URL.RawQuery != "" {
+		path += "?" + request.URL.RawQuery
+	}
+
+	digest := sha256.Sum256(body)
+
+	return []byte(strings.Join([]string{
+		strings.ToUpper(request.Method),
+		path,
+		timestamp,
+		hex.EncodeToString(digest[:]),
+	}, "\n"))
+}
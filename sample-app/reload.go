@@ -0,0 +1,140 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// reloadableOptions are the options whose changes are applied on SIGHUP
+// without a restart; changes to any other option are logged & ignored
+var reloadableOptions = map[string]bool{
+	"vault-api-key-path":       true,
+	"vault-api-key-mount-path": true,
+	"vault-api-key-descriptor": true,
+	"secure-service-address":   true,
+}
+
+// ConfigReloader re-reads the configuration (config file, environment
+// variables & flags) on SIGHUP and applies the changes which are safe to
+// apply to the running app: where the api key is stored & the address of the
+// secure service. Anything which would require logging in to Vault again,
+// new database credentials or a new listener is left as is until the next
+// restart, so that the existing token & leases are kept.
+type ConfigReloader struct {
+	args     []string
+	current  Environment
+	vault    *Vault
+	handlers *Handlers
+}
+
+func NewConfigReloader(args []string, current Environment, v *Vault, h *Handlers) *ConfigReloader {
+	return &ConfigReloader{
+		args:     args,
+		current:  current,
+		vault:    v,
+		handlers: h,
+	}
+}
+
+// ReloadOnSignal reloads the configuration every time SIGHUP is received,
+// until ctx is done. It should be run as a goroutine.
+func (r *ConfigReloader) ReloadOnSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			r.reload()
+		}
+	}
+}
+
+func (r *ConfigReloader) reload() {
+	log.Println("reloading configuration")
+
+	var next Environment
+
+	parser, err := newParser(&next, flags.None)
+	if err == nil {
+		err = loadEnvironment(parser, &next, r.args)
+	}
+	if err != nil {
+		log.Printf("reloading configuration: keeping the current configuration: %v", err)
+		return
+	}
+
+	current := reflect.ValueOf(&r.current).Elem()
+	updated := reflect.ValueOf(next)
+
+	var applied []string
+
+	for i := 0; i < current.NumField(); i++ {
+		field := current.Type().Field(i)
+
+		name := field.Tag.Get("long")
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		if reflect.DeepEqual(current.Field(i).Interface(), updated.Field(i).Interface()) {
+			continue
+		}
+
+		if !reloadableOptions[name] {
+			log.Printf("reloading configuration: ignoring the change to %q: %s; restart to apply it", name, restartReason(name))
+			continue
+		}
+
+		log.Printf("reloading configuration: %q: %v -> %v", name, current.Field(i).Interface(), updated.Field(i).Interface())
+
+		current.Field(i).Set(updated.Field(i))
+		applied = append(applied, name)
+	}
+
+	if len(applied) == 0 {
+		log.Println("reloading configuration: nothing to apply")
+		return
+	}
+
+	r.vault.SetAPIKeyLocation(APIKeyLocation{
+		MountPath: r.current.VaultAPIKeyMountPath,
+		Path:      r.current.VaultAPIKeyPath,
+		Field:     r.current.VaultAPIKeyField,
+	})
+
+	r.handlers.SetSecureServiceAddress(r.current.SecureServiceAddress)
+
+	log.Printf("reloading configuration: success! (applied %s)", strings.Join(applied, ", "))
+}
+
+// restartReason explains why a change to the given option cannot be applied
+// to the running app
+func restartReason(name string) string {
+	switch {
+	case name == "vault-address" || strings.HasPrefix(name, "vault-approle-"):
+		return "it would require logging in to vault again, which would invalidate our token & leases"
+	case name == "vault-database-creds-path" || strings.HasPrefix(name, "database-"):
+		return "it would require new database credentials & a new database connection"
+	case strings.HasPrefix(name, "my-"):
+		return "it would require restarting the server"
+	case name == "secrets":
+		return "the declared secrets are read (& leased) at startup"
+	default:
+		return "it is only read at startup"
+	}
+}
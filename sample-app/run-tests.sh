@@ -4,6 +4,8 @@
 
 
 APP_ADDRESS="http://localhost:8080"
+CLIENT_TOKEN="insecure-client-token"
+ADMIN_TOKEN="insecure-admin-token"
 
 # bring up hello-vault-go service and its dependencies
 docker compose up -d --build --quiet-pull
@@ -12,7 +14,7 @@ docker compose up -d --build --quiet-pull
 trap 'docker compose down --volumes' EXIT
 
 # TEST 1: POST /payments (static secrets)
-output1=$(curl --silent --request POST "${APP_ADDRESS}/payments")
+output1=$(curl --silent --header "X-Vault-Token: ${CLIENT_TOKEN}" --request POST "${APP_ADDRESS}/payments")
 
 echo "[TEST 1]: output: $output1"
 
@@ -25,7 +27,7 @@ else
 fi
 
 # TEST 2: GET /products (dynamic secrets)
-output2=$(curl --silent --request GET "${APP_ADDRESS}/products")
+output2=$(curl --silent --header "X-Vault-Token: ${CLIENT_TOKEN}" --request GET "${APP_ADDRESS}/products")
 
 echo "[TEST 2]: output: $output2"
 
@@ -36,3 +38,112 @@ then
 else
     echo "[TEST 2]: OK"
 fi
+
+# TEST 3: POST /customers & GET /customers/:id (encryption as a service)
+customer='{"id":1,"first_name":"Winston","last_name":"Higginsbury","email":"higgs@example.com","phone":"555-555-5555","address":"1 Main St"}'
+
+output3=$(curl --silent --header "X-Vault-Token: ${CLIENT_TOKEN}" --request POST "${APP_ADDRESS}/customers" --data '{"first_name":"Winston","last_name":"Higginsbury","email":"higgs@example.com","phone":"555-555-5555","address":"1 Main St"}')
+
+echo "[TEST 3]: POST output: $output3"
+
+if [ "${output3}" != "${customer}" ]
+then
+    echo "[TEST 3]: FAILED: unexpected POST output"
+    exit 1
+fi
+
+output3=$(curl --silent --header "X-Vault-Token: ${CLIENT_TOKEN}" --request GET "${APP_ADDRESS}/customers/1")
+
+echo "[TEST 3]: GET output: $output3"
+
+if [ "${output3}" != "${customer}" ]
+then
+    echo "[TEST 3]: FAILED: unexpected GET output"
+    exit 1
+else
+    echo "[TEST 3]: OK"
+fi
+
+# TEST 4: the secure service's https listener only accepts vault pki client certificates
+docker compose exec -T vault-server sh -c '
+    export VAULT_ADDR="http://127.0.0.1:8200" VAULT_TOKEN="${VAULT_DEV_ROOT_TOKEN_ID}"
+    vault write -format=json pki/issue/hello-vault-client common_name=hello-vault ttl=5m > /tmp/client.json
+    jq -r ".data.certificate" /tmp/client.json > "${SECURE_SERVICE_TLS_DIR}/test-client.crt"
+    jq -r ".data.private_key" /tmp/client.json > "${SECURE_SERVICE_TLS_DIR}/test-client.key"
+    rm /tmp/client.json
+'
+
+output4=$(docker compose exec -T secure-service curl --silent --output /dev/null --write-out '%{http_code}' --cacert /etc/nginx/tls/ca.crt https://localhost/api)
+
+echo "[TEST 4]: status without a client certificate: $output4"
+
+if [ "${output4}" != "400" ]
+then
+    echo "[TEST 4]: FAILED: a request without a client certificate was not rejected"
+    exit 1
+fi
+
+output4=$(docker compose exec -T secure-service curl --silent --cacert /etc/nginx/tls/ca.crt --cert /etc/nginx/tls/test-client.crt --key /etc/nginx/tls/test-client.key https://localhost/api)
+
+echo "[TEST 4]: output: $output4"
+
+if [ "${output4}" != '{"message":"hello world!"}' ]
+then
+    echo "[TEST 4]: FAILED: unexpected output"
+    exit 1
+else
+    echo "[TEST 4]: OK"
+fi
+
+# TEST 5: the secure service verifies signed requests with vault's transit/verify
+output5=$(docker compose exec -T vault-server sh -c '
+    export VAULT_ADDR="http://127.0.0.1:8200" VAULT_TOKEN="${VAULT_DEV_ROOT_TOKEN_ID}"
+    timestamp=$(date +%s)
+    digest=$(printf "" | sha256sum | cut -d " " -f 1)
+    input=$(printf "POST\n/api\n%s\n%s" "${timestamp}" "${digest}" | base64 | tr -d "\n")
+    signature=$(vault write -field=signature "transit/sign/${TRANSIT_SIGNING_KEY}" input="${input}")
+    echo "${timestamp} ${signature}"
+')
+
+timestamp=${output5% *}
+signature=${output5#* }
+
+output5=$(curl --silent --request POST --header "X-Signature: ${signature}" --header "X-Signature-Timestamp: ${timestamp}" --header "X-Signature-Mode: sign" http://localhost:1717/api)
+
+echo "[TEST 5]: output: $output5"
+
+if [ "${output5}" != '{"message":"hello world!"}' ]
+then
+    echo "[TEST 5]: FAILED: unexpected output"
+    exit 1
+fi
+
+output5=$(curl --silent --output /dev/null --write-out '%{http_code}' --request POST --header "X-Signature: vault:v1:AAAA" --header "X-Signature-Timestamp: ${timestamp}" --header "X-Signature-Mode: sign" http://localhost:1717/api)
+
+echo "[TEST 5]: status with a forged signature: $output5"
+
+if [ "${output5}" != "401" ]
+then
+    echo "[TEST 5]: FAILED: a request with a forged signature was not rejected"
+    exit 1
+else
+    echo "[TEST 5]: OK"
+fi
+
+# TEST 6: POST /decrypt reports the error of a single bad batch item instead of failing the whole batch
+ciphertext=$(curl --silent --header "X-Vault-Token: ${ADMIN_TOKEN}" --header "Content-Type: application/json" --request POST --data '{"key":"app-data","plaintext":"aGVsbG8="}' "${APP_ADDRESS}/encrypt" \
+    | sed -n 's/.*"ciphertext":"\([^"]*\)".*/\1/p')
+
+output6=$(curl --silent --header "X-Vault-Token: ${ADMIN_TOKEN}" --header "Content-Type: application/json" --request POST \
+    --data "{\"key\":\"app-data\",\"batch_input\":[{\"ciphertext\":\"${ciphertext}\"},{\"ciphertext\":\"vault:v1:bm90LWEtY2lwaGVydGV4dA==\"}]}" \
+    "${APP_ADDRESS}/decrypt")
+
+echo "[TEST 6]: output: $output6"
+
+if [ "${output6}" != '{"batch_results":[{"plaintext":"aGVsbG8="},{"error":"the item was rejected by vault"}]}' ]
+then
+    echo "[TEST 6]: FAILED: unexpected output"
+    exit 1
+else
+    echo "[TEST 6]: OK"
+fi
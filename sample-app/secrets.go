@@ -0,0 +1,281 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSecretNotDeclared = errors.New("secret is not declared")
+	ErrSecretField       = errors.New("secret field is missing or has an unexpected type")
+)
+
+// SecretEngine is the secrets engine a named secret is read from
+type SecretEngine string
+
+const (
+	SecretEngineKVv2     SecretEngine = "kv-v2"    // <mount>/data/<path>
+	SecretEngineKVv1     SecretEngine = "kv-v1"    // <mount>/<path>
+	SecretEngineDatabase SecretEngine = "database" // <mount>/creds/<path>, leased
+)
+
+// The refresh policies of named secrets, in addition to a duration (e.g.
+// "5m") which re-reads the secret in the background at that interval
+const (
+	SecretRefreshAlways = "always" // read from vault every time the secret is requested
+	SecretRefreshOnce   = "once"   // read at startup & never again
+	SecretRefreshLease  = "lease"  // renew the lease; read again once it can no longer be renewed
+)
+
+// SecretDefinition declares a named secret in the "secrets" section of the
+// config file, e.g.
+//
+//	secrets:
+//	  payments-api-key:
+//	    engine: kv-v2
+//	    path: api-key
+//	    fields: [api-key-field]
+//	    refresh: 30s
+//
+// so that adding a secret does not require new options; the secret is then
+// available through Vault.Secret.
+type SecretDefinition struct {
+	Engine  SecretEngine `json:"engine"            yaml:"engine"`
+	Mount   string       `json:"mount,omitempty"   yaml:"mount,omitempty"`   // defaults to the engine's usual mount path
+	Path    string       `json:"path"              yaml:"path"`              // relative to the mount; the role name for database secrets
+	Fields  []string     `json:"fields,omitempty"  yaml:"fields,omitempty"`  // required & the only ones exposed; all fields if empty
+	Refresh string       `json:"refresh,omitempty" yaml:"refresh,omitempty"` // always, once, lease or a duration; see SecretRefresh*
+
+	refreshInterval time.Duration // parsed from Refresh, if it is a duration
+}
+
+// ParseSecretDefinitions decodes & validates the "secrets" section of a config
+// file, as decoded from YAML, HCL or JSON
+func ParseSecretDefinitions(section interface{}) (map[string]SecretDefinition, error) {
+	b, err := json.Marshal(mergeHCLObjects(section))
+	if err != nil {
+		return nil, fmt.Errorf("malformed secrets section: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+
+	var definitions map[string]SecretDefinition
+
+	if err := decoder.Decode(&definitions); err != nil {
+		return nil, fmt.Errorf("invalid secrets section: %w", err)
+	}
+
+	// sorted, so that the first problem reported is always the same one
+	names := make([]string, 0, len(definitions))
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		definition, err := definitions[name].withDefaults()
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret %q: %w", name, err)
+		}
+		definitions[name] = definition
+	}
+
+	return definitions, nil
+}
+
+// mergeHCLObjects undoes the way HCL decodes objects & blocks into lists of
+// maps, by merging each such list into a single map
+func mergeHCLObjects(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []map[string]interface{}:
+		merged := make(map[string]interface{})
+		for _, m := range v {
+			for key, item := range m {
+				merged[key] = mergeHCLObjects(item)
+			}
+		}
+		return merged
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = mergeHCLObjects(item)
+		}
+		return v
+	default:
+		return value
+	}
+}
+
+// withDefaults validates the definition & fills in the default mount path &
+// refresh policy of its engine
+func (d SecretDefinition) withDefaults() (SecretDefinition, error) {
+	if strings.Trim(d.Path, "/") == "" {
+		return d, fmt.Errorf("a path is required")
+	}
+
+	switch d.Engine {
+	case SecretEngineKVv2, SecretEngineKVv1:
+		if d.Mount == "" {
+			d.Mount = map[SecretEngine]string{SecretEngineKVv2: "kv-v2", SecretEngineKVv1: "kv"}[d.Engine]
+		}
+		if d.Refresh == "" {
+			d.Refresh = SecretRefreshAlways
+		}
+		if d.Refresh == SecretRefreshLease {
+			return d, fmt.Errorf("the %q refresh policy only applies to leased secrets", SecretRefreshLease)
+		}
+	case SecretEngineDatabase:
+		if d.Mount == "" {
+			d.Mount = "database"
+		}
+		if d.Refresh == "" {
+			d.Refresh = SecretRefreshLease
+		}
+		if d.Refresh != SecretRefreshLease {
+			return d, fmt.Errorf("database credentials only support the %q refresh policy", SecretRefreshLease)
+		}
+	default:
+		return d, fmt.Errorf("unknown engine %q: expected %s, %s or %s", d.Engine, SecretEngineKVv2, SecretEngineKVv1, SecretEngineDatabase)
+	}
+
+	switch d.Refresh {
+	case SecretRefreshAlways, SecretRefreshOnce, SecretRefreshLease:
+	default:
+		interval, err := time.ParseDuration(d.Refresh)
+		if err != nil || interval <= 0 {
+			return d, fmt.Errorf("invalid refresh policy %q: expected %s, %s, %s or a positive duration", d.Refresh, SecretRefreshAlways, SecretRefreshOnce, SecretRefreshLease)
+		}
+		d.refreshInterval = interval
+	}
+
+	d.Mount = strings.Trim(d.Mount, "/")
+	d.Path = strings.Trim(d.Path, "/")
+
+	return d, nil
+}
+
+// databaseSecretDefinition declares the database credentials read from the
+// given path ("<mount>/creds/<role>") as a named secret
+func databaseSecretDefinition(credentialsPath string) (SecretDefinition, error) {
+	mount, role, ok := strings.Cut(strings.Trim(credentialsPath, "/"), "/creds/")
+	if !ok {
+		return SecretDefinition{}, fmt.Errorf("invalid database credentials path %q: expected <mount>/creds/<role>", credentialsPath)
+	}
+
+	return SecretDefinition{Engine: SecretEngineDatabase, Mount: mount, Path: role}.withDefaults()
+}
+
+// SecretValue is a named secret as read from vault; its fields are accessed
+// with the typed getters below, or decoded into a struct with Decode
+type SecretValue struct {
+	Name          string
+	Data          map[string]interface{}
+	Version       int           // kv-v2 only
+	LeaseID       string        // leased secrets only
+	LeaseDuration time.Duration // leased secrets only
+	FetchedAt     time.Time
+}
+
+// String returns the given string field of the secret
+func (s SecretValue) String(field string) (string, error) {
+	value, ok := s.Data[field].(string)
+	if !ok {
+		return "", s.fieldError(field, "a string")
+	}
+
+	return value, nil
+}
+
+// Int returns the given integer field of the secret; strings holding an
+// integer are accepted as well, since kv secrets are often written as strings
+func (s SecretValue) Int(field string) (int, error) {
+	switch value := s.Data[field].(type) {
+	case json.Number:
+		if i, err := strconv.Atoi(value.String()); err == nil {
+			return i, nil
+		}
+	case float64:
+		if i := int(value); float64(i) == value {
+			return i, nil
+		}
+	case string:
+		if i, err := strconv.Atoi(value); err == nil {
+			return i, nil
+		}
+	}
+
+	return 0, s.fieldError(field, "an integer")
+}
+
+// Bool returns the given boolean field of the secret; strings such as "true"
+// are accepted as well
+func (s SecretValue) Bool(field string) (bool, error) {
+	switch value := s.Data[field].(type) {
+	case bool:
+		return value, nil
+	case string:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b, nil
+		}
+	}
+
+	return false, s.fieldError(field, "a boolean")
+}
+
+// Duration returns the given duration field of the secret, e.g. "30s"; plain
+// numbers are taken as seconds, like vault does
+func (s SecretValue) Duration(field string) (time.Duration, error) {
+	if value, ok := s.Data[field].(string); ok {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d, nil
+		}
+	}
+
+	if seconds, err := s.Int(field); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	return 0, s.fieldError(field, "a duration")
+}
+
+// Decode decodes the secret's fields into the given struct, using its json tags
+func (s SecretValue) Decode(v interface{}) error {
+	b, err := json.Marshal(s.Data)
+	if err != nil {
+		return fmt.Errorf("malformed secret %q: %w", s.Name, err)
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("unable to unmarshal secret %q: %w", s.Name, err)
+	}
+
+	return nil
+}
+
+func (s SecretValue) fieldError(field, expected string) error {
+	if _, ok := s.Data[field]; !ok {
+		return fmt.Errorf("%w: secret %q has no %q field", ErrSecretField, s.Name, field)
+	}
+
+	return fmt.Errorf("%w: the %q field of secret %q is not %s", ErrSecretField, field, s.Name, expected)
+}
+
+// clone copies the fields, so that callers cannot modify the kept value
+func (s SecretValue) clone() SecretValue {
+	data := make(map[string]interface{}, len(s.Data))
+	for field, value := range s.Data {
+		data[field] = value
+	}
+	s.Data = data
+
+	return s
+}
@@ -0,0 +1,283 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"gopkg.in/yaml.v3"
+)
+
+// decodeSecretsSection decodes the "secrets" section of a config file the
+// same way applyConfigFile does
+func decodeSecretsSection(t *testing.T, format, config string) interface{} {
+	t.Helper()
+
+	values := make(map[string]interface{})
+
+	var err error
+
+	switch format {
+	case "yaml":
+		err = yaml.Unmarshal([]byte(config), &values)
+	case "hcl":
+		err = hcl.Decode(&values, config)
+	}
+	if err != nil {
+		t.Fatalf("unable to decode the %s config: %v", format, err)
+	}
+
+	return values["secrets"]
+}
+
+func TestParseSecretDefinitions(t *testing.T) {
+	expected := map[string]SecretDefinition{
+		"payments-api-key": {
+			Engine:          SecretEngineKVv2,
+			Mount:           "kv-v2",
+			Path:            "api-key",
+			Fields:          []string{"api-key-field"},
+			Refresh:         "30s",
+			refreshInterval: 30 * time.Second,
+		},
+		"legacy": {
+			Engine:  SecretEngineKVv1,
+			Mount:   "secret",
+			Path:    "legacy/config",
+			Refresh: SecretRefreshOnce,
+		},
+		"reporting-db": {
+			Engine:  SecretEngineDatabase,
+			Mount:   "database",
+			Path:    "dev-readonly",
+			Refresh: SecretRefreshLease,
+		},
+	}
+
+	tests := []struct {
+		name   string
+		format string
+		config string
+	}{
+		{
+			name:   "yaml",
+			format: "yaml",
+			config: `
+secrets:
+  payments-api-key:
+    engine: kv-v2
+    path: api-key
+    fields: [api-key-field]
+    refresh: 30s
+  legacy:
+    engine: kv-v1
+    mount: /secret/
+    path: /legacy/config
+    refresh: once
+  reporting-db:
+    engine: database
+    path: dev-readonly
+`,
+		},
+		{
+			// each block is decoded into its own list of maps, which must be merged
+			name:   "hcl blocks",
+			format: "hcl",
+			config: `
+secrets "payments-api-key" {
+  engine  = "kv-v2"
+  path    = "api-key"
+  fields  = ["api-key-field"]
+  refresh = "30s"
+}
+
+secrets "legacy" {
+  engine  = "kv-v1"
+  mount   = "/secret/"
+  path    = "/legacy/config"
+  refresh = "once"
+}
+
+secrets "reporting-db" {
+  engine = "database"
+  path   = "dev-readonly"
+}
+`,
+		},
+		{
+			name:   "hcl object",
+			format: "hcl",
+			config: `
+secrets = {
+  payments-api-key = {
+    engine  = "kv-v2"
+    path    = "api-key"
+    fields  = ["api-key-field"]
+    refresh = "30s"
+  }
+  legacy = {
+    engine  = "kv-v1"
+    mount   = "/secret/"
+    path    = "/legacy/config"
+    refresh = "once"
+  }
+  reporting-db = {
+    engine = "database"
+    path   = "dev-readonly"
+  }
+}
+`,
+		},
+		{
+			name:   "json",
+			format: "hcl", // json config files are decoded with the hcl parser
+			config: `{
+  "secrets": {
+    "payments-api-key": {"engine": "kv-v2", "path": "api-key", "fields": ["api-key-field"], "refresh": "30s"},
+    "legacy": {"engine": "kv-v1", "mount": "/secret/", "path": "/legacy/config", "refresh": "once"},
+    "reporting-db": {"engine": "database", "path": "dev-readonly"}
+  }
+}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			definitions, err := ParseSecretDefinitions(decodeSecretsSection(t, tt.format, tt.config))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(definitions, expected) {
+				t.Errorf("unexpected definitions:\n got: %+v\nwant: %+v", definitions, expected)
+			}
+		})
+	}
+}
+
+func TestParseSecretDefinitionsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name: "unknown field",
+			config: `
+secrets:
+  api-key:
+    engine: kv-v2
+    path: api-key
+    refersh: 30s
+`,
+			wantErr: `unknown field "refersh"`,
+		},
+		{
+			name: "unknown engine",
+			config: `
+secrets:
+  api-key:
+    engine: kv-v3
+    path: api-key
+`,
+			wantErr: `unknown engine "kv-v3"`,
+		},
+		{
+			name: "missing path",
+			config: `
+secrets:
+  api-key:
+    engine: kv-v2
+    path: /
+`,
+			wantErr: "a path is required",
+		},
+		{
+			name: "lease refresh for a kv secret",
+			config: `
+secrets:
+  api-key:
+    engine: kv-v2
+    path: api-key
+    refresh: lease
+`,
+			wantErr: `the "lease" refresh policy only applies to leased secrets`,
+		},
+		{
+			name: "interval refresh for database credentials",
+			config: `
+secrets:
+  reporting-db:
+    engine: database
+    path: dev-readonly
+    refresh: 5m
+`,
+			wantErr: `database credentials only support the "lease" refresh policy`,
+		},
+		{
+			name: "invalid refresh",
+			config: `
+secrets:
+  api-key:
+    engine: kv-v2
+    path: api-key
+    refresh: sometimes
+`,
+			wantErr: `invalid refresh policy "sometimes"`,
+		},
+		{
+			name: "negative refresh interval",
+			config: `
+secrets:
+  api-key:
+    engine: kv-v2
+    path: api-key
+    refresh: -5m
+`,
+			wantErr: `invalid refresh policy "-5m"`,
+		},
+		{
+			name: "not a map",
+			config: `
+secrets: [api-key]
+`,
+			wantErr: "invalid secrets section",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSecretDefinitions(decodeSecretsSection(t, "yaml", tt.config))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDatabaseSecretDefinition(t *testing.T) {
+	definition, err := databaseSecretDefinition("database/creds/dev-migrations")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := SecretDefinition{
+		Engine:  SecretEngineDatabase,
+		Mount:   "database",
+		Path:    "dev-migrations",
+		Refresh: SecretRefreshLease,
+	}
+
+	if !reflect.DeepEqual(definition, expected) {
+		t.Errorf("unexpected definition:\n got: %+v\nwant: %+v", definition, expected)
+	}
+
+	if _, err := databaseSecretDefinition("database/dev-migrations"); err == nil {
+		t.Error("expected an error for a path without /creds/")
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type SecureServiceClientParameters struct {
+	timeout             time.Duration // per attempt, including reading the response body
+	maxRetries          int           // retries of idempotent requests after a failed attempt
+	retryBackoff        time.Duration // doubled after every retry
+	maxIdleConnsPerHost int
+	breakerThreshold    int           // consecutive failures after which the circuit opens
+	breakerCooldown     time.Duration // how long the circuit stays open before a trial request is let through
+}
+
+// maxRetryBackoff caps the delay between retries, however many retries are
+// configured
+const maxRetryBackoff = 10 * time.Second
+
+// ErrCircuitOpen is returned without sending the request when the secure
+// service has failed too many times in a row
+var ErrCircuitOpen = errors.New("secure service is unavailable (circuit breaker is open)")
+
+// SecureServiceClient is the outbound http client used to talk to the secure
+// service. Unlike http.DefaultClient, it limits how long each attempt may
+// take, retries idempotent requests which failed for transient reasons with
+// an exponential backoff, stops calling the service for a while after
+// repeated failures (circuit breaker), and propagates the correlation id of
+// the incoming request.
+type SecureServiceClient struct {
+	client     *http.Client
+	parameters SecureServiceClientParameters
+	breaker    circuitBreaker
+}
+
+// NewSecureServiceClient creates a client with its own connection pool; the
+// optional tlsConfig is used for https connections (e.g. for mutual tls)
+func NewSecureServiceClient(parameters SecureServiceClientParameters, tlsConfig *tls.Config) *SecureServiceClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = parameters.maxIdleConnsPerHost
+	transport.TLSClientConfig = tlsConfig
+
+	return &SecureServiceClient{
+		client: &http.Client{
+			Transport: transport,
+		},
+		parameters: parameters,
+		breaker: circuitBreaker{
+			threshold: parameters.breakerThreshold,
+			cooldown:  parameters.breakerCooldown,
+		},
+	}
+}
+
+// mutualTLSConfig returns a tls config which authenticates with a client
+// certificate issued by Vault PKI (looked up on every handshake, so that
+// renewed certificates are picked up) and only trusts server certificates
+// signed by the given CAs
+func mutualTLSConfig(certificate *Certificate, rootCAs *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		RootCAs:              rootCAs,
+		GetClientCertificate: certificate.GetClientCertificate,
+	}
+}
+
+// Do sends the request, retrying it if it is safe to do so. The request's
+// context (normally derived from the incoming request) bounds all attempts.
+func (c *SecureServiceClient) Do(request *http.Request) (*http.Response, error) {
+	if id := correlationIDFromContext(request.Context()); id != "" {
+		request.Header.Set(correlationIDHeader, id)
+	}
+
+	backoff := clampRetryBackoff(c.parameters.retryBackoff)
+
+	for attempt := 0; ; attempt++ {
+		if !c.breaker.allow() {
+			return nil, ErrCircuitOpen
+		}
+
+		response, err := c.do(request)
+
+		// the incoming request was cancelled (e.g. the caller went away), which
+		// says nothing about the health of the secure service
+		if request.Context().Err() != nil {
+			c.breaker.release()
+			return response, err
+		}
+
+		// any 5xx counts against the circuit breaker, but only the failures
+		// which are likely to go away are worth retrying
+		c.breaker.record(err == nil && !isServiceFailure(response.StatusCode))
+
+		failed := err != nil || isTransientFailure(response.StatusCode)
+
+		if !failed || attempt >= c.parameters.maxRetries || !isRetryable(request) {
+			return response, err
+		}
+
+		if err != nil {
+			log.Printf("secure service request failed (attempt %d, will retry in %s): %v", attempt+1, backoff, err)
+		} else {
+			log.Printf("secure service request failed (attempt %d, will retry in %s): status %d", attempt+1, backoff, response.StatusCode)
+			_ = response.Body.Close()
+		}
+
+		// add some jitter so that concurrent retries don't arrive at the same time
+		select {
+		case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))):
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		}
+
+		backoff = clampRetryBackoff(backoff * 2)
+
+		if request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("unable to rewind request body: %w", err)
+			}
+			request.Body = body
+		}
+	}
+}
+
+// do sends a single attempt bounded by the per-attempt timeout
+func (c *SecureServiceClient) do(request *http.Request) (*http.Response, error) {
+	ctx, cancelContextFunc := context.WithTimeout(request.Context(), c.parameters.timeout)
+
+	response, err := c.client.Do(request.WithContext(ctx))
+	if err != nil {
+		cancelContextFunc()
+		return nil, err
+	}
+
+	// the timeout also applies to reading the body, so only cancel once it's closed
+	response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: cancelContextFunc}
+
+	return response, nil
+}
+
+// isRetryable checks whether the request can safely be sent more than once:
+// it must be idempotent (by method or thanks to an Idempotency-Key header)
+// and its body, if any, must be rewindable
+func isRetryable(request *http.Request) bool {
+	if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+		return false
+	}
+
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return request.Header.Get("Idempotency-Key") != ""
+}
+
+// isTransientFailure checks whether a response indicates a failure which is
+// likely to go away if we try again later
+func isTransientFailure(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// isServiceFailure checks whether a response indicates that the secure service
+// is unhealthy: any 5xx, or a 429 asking us to back off
+func isServiceFailure(statusCode int) bool {
+	return statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests
+}
+
+// clampRetryBackoff keeps the backoff between 0 (e.g. a negative configured
+// value) and maxRetryBackoff, so that doubling it can neither overflow nor
+// make the jitter computation panic
+func clampRetryBackoff(backoff time.Duration) time.Duration {
+	switch {
+	case backoff < 0:
+		return 0
+	case backoff > maxRetryBackoff:
+		return maxRetryBackoff
+	}
+
+	return backoff
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+
+	return c.ReadCloser.Close()
+}
+
+// circuitBreaker opens after a number of consecutive failures, rejecting all
+// requests until the cooldown has passed. Then a single trial request is let
+// through (half-open): its success closes the circuit, its failure re-opens it.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mutex    sync.Mutex
+	failures int
+	openedAt time.Time // zero if the circuit is closed
+	trial    bool      // a trial request is in flight
+}
+
+func (b *circuitBreaker) allow() bool {
+	/* */ b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.threshold <= 0 || b.openedAt.IsZero() {
+		return true
+	}
+
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+
+	b.trial = true
+
+	return true
+}
+
+// release gives up a request without recording its outcome, so that another
+// trial request can be let through if this one was the trial
+func (b *circuitBreaker) release() {
+	/* */ b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trial = false
+}
+
+func (b *circuitBreaker) record(success bool) {
+	/* */ b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trial = false
+
+	if success {
+		if !b.openedAt.IsZero() {
+			log.Println("secure service circuit breaker: closed")
+		}
+		b.failures = 0
+		b.openedAt = time.Time{}
+		return
+	}
+
+	b.failures++
+
+	if b.threshold > 0 && b.failures >= b.threshold {
+		if b.openedAt.IsZero() {
+			log.Printf("secure service circuit breaker: open after %d consecutive failures", b.failures)
+		}
+		b.openedAt = time.Now()
+	}
+}
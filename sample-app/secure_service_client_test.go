@@ -0,0 +1,121 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSecureServiceClientBreaker(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		wantOpen   bool
+	}{
+		{"500", http.StatusInternalServerError, true},
+		{"503", http.StatusServiceUnavailable, true},
+		{"429", http.StatusTooManyRequests, true},
+		{"400", http.StatusBadRequest, false},
+		{"200", http.StatusOK, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statusCode)
+			}))
+			t.Cleanup(server.Close)
+
+			client := NewSecureServiceClient(SecureServiceClientParameters{
+				timeout:          time.Second,
+				breakerThreshold: 2,
+				breakerCooldown:  time.Minute,
+			}, nil)
+
+			// payments are not retried, so each call is a single attempt
+			for i := 0; i < 2; i++ {
+				request, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("{}"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				response, err := client.Do(request)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				_ = response.Body.Close()
+			}
+
+			request, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := client.Do(request)
+			if response != nil {
+				_ = response.Body.Close()
+			}
+
+			if open := errors.Is(err, ErrCircuitOpen); open != tt.wantOpen {
+				t.Errorf("expected the circuit to be open: %t, got error %v", tt.wantOpen, err)
+			}
+		})
+	}
+}
+
+func TestSecureServiceClientNegativeBackoff(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewSecureServiceClient(SecureServiceClientParameters{
+		timeout:      time.Second,
+		maxRetries:   2,
+		retryBackoff: -time.Second,
+	}, nil)
+
+	request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = response.Body.Close()
+
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+}
+
+func TestClampRetryBackoff(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		want    time.Duration
+	}{
+		{-time.Second, 0},
+		{0, 0},
+		{100 * time.Millisecond, 100 * time.Millisecond},
+		{maxRetryBackoff * 2, maxRetryBackoff},
+		{time.Duration(1 << 62), maxRetryBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := clampRetryBackoff(tt.backoff); got != tt.want {
+			t.Errorf("clampRetryBackoff(%s): expected %s, got %s", tt.backoff, tt.want, got)
+		}
+	}
+}
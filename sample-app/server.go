@@ -0,0 +1,80 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// listenAndServe serves http (or https if a certificate is given) until the
+// process is asked to stop (SIGINT / SIGTERM) or the given context is done.
+// It then stops accepting new connections and waits up to drainTimeout for
+// in-flight requests to finish before returning, so that the caller can
+// release the resources used by the handlers (database, leases, etc.).
+//
+// With https, the server certificate is looked up on every handshake, so it
+// can be swapped while the server is running without dropping connections.
+func listenAndServe(ctx context.Context, address string, handler http.Handler, certificate *Certificate, drainTimeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{
+		Addr:    address,
+		Handler: handler,
+	}
+
+	if certificate != nil {
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certificate.GetCertificate,
+		}
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		if certificate != nil {
+			// the certificate & key are provided by TLSConfig.GetCertificate
+			errCh <- server.ListenAndServeTLS("", "")
+		} else {
+			errCh <- server.ListenAndServe()
+		}
+	}()
+
+	if certificate != nil {
+		log.Printf("serving https @ %s", address)
+	} else {
+		log.Printf("serving http @ %s", address)
+	}
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("server error: %w", err)
+	case <-ctx.Done():
+	}
+
+	// restore the default signal behavior: a second signal kills the process
+	stop()
+
+	log.Printf("shutting down the server: draining in-flight requests (up to %s)", drainTimeout)
+
+	shutdownCtx, cancelShutdownFunc := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancelShutdownFunc()
+
+	if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("unable to drain in-flight requests: %w", err)
+	}
+
+	log.Println("shutting down the server: done")
+
+	return nil
+}
@@ -8,6 +8,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	vault "github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/api/auth/approle"
@@ -23,12 +25,52 @@ type VaultParameters struct {
 	apiKeyPath              string
 	apiKeyMountPath         string
 	apiKeyField             string
+	apiKeyVersion           int // 0 means "the latest version"
 	databaseCredentialsPath string
+
+	// how often the cached api key is checked for a new version & how long
+	// the last good api key can still be served while vault is unavailable
+	apiKeyCacheTTL          time.Duration
+	apiKeyCacheMaxStaleness time.Duration
+
+	// for how long after a rotation the previous api key version is still tried
+	apiKeyRotationGracePeriod time.Duration
+
+	// the pki secrets engine mount used to issue tls certificates
+	pkiMountPath string
+
+	// the transit secrets engine mount & the key used to encrypt customer data
+	transitMountPath        string
+	transitCustomersKeyName string
+
+	// how many unwrapped envelope encryption data keys are cached & for how long
+	transitDataKeyCacheSize int
+	transitDataKeyCacheTTL  time.Duration
+
+	// any number of named secrets declared in the config file, see Secret
+	secrets map[string]SecretDefinition
 }
 
 type Vault struct {
 	client     *vault.Client
 	parameters VaultParameters
+
+	// where the secret api key is stored; it starts out as configured in the
+	// parameters & can be changed while running, see SetAPIKeyLocation
+	apiKeyLocationMutex sync.RWMutex
+	apiKeyLocation      APIKeyLocation
+
+	// the last good version of the secret api key, see GetSecretAPIKey
+	apiKeyCache apiKeyCache
+
+	// signals the renewal loop to fetch new database credentials immediately
+	databaseCredentialsRefreshCh chan struct{}
+
+	// unwrapped envelope encryption data keys, see EnvelopeDecrypt
+	dataKeyCache *dataKeyCache
+
+	// the current values of the named secrets, see Secret
+	namedSecrets namedSecrets
 }
 
 // NewVaultAppRoleClient logs in to Vault using the AppRole authentication
@@ -39,6 +81,7 @@ func NewVaultAppRoleClient(ctx context.Context, parameters VaultParameters) (*Va
 
 	config := vault.DefaultConfig() // modify for more granular configuration
 	config.Address = parameters.address
+	config.HttpClient.Transport = &vaultTransport{config.HttpClient.Transport} // see vaultErrorKind
 
 	client, err := vault.NewClient(config)
 	if err != nil {
@@ -46,8 +89,11 @@ func NewVaultAppRoleClient(ctx context.Context, parameters VaultParameters) (*Va
 	}
 
 	vault := &Vault{
-		client:     client,
-		parameters: parameters,
+		client:                       client,
+		parameters:                   parameters,
+		apiKeyLocation:               APIKeyLocation{MountPath: parameters.apiKeyMountPath, Path: parameters.apiKeyPath, Field: parameters.apiKeyField},
+		databaseCredentialsRefreshCh: make(chan struct{}, 1),
+		dataKeyCache:                 newDataKeyCache(parameters.transitDataKeyCacheSize, parameters.transitDataKeyCacheTTL),
 	}
 
 	token, err := vault.login(ctx)
@@ -98,35 +144,146 @@ func (v *Vault) login(ctx context.Context) (*vault.Secret, error) {
 	return authInfo, nil
 }
 
-// GetSecretAPIKey fetches the latest version of secret api key from kv-v2
-func (v *Vault) GetSecretAPIKey(ctx context.Context) (string, error) {
+// APIKeyLocation is where the secret api key is stored in kv-v2
+type APIKeyLocation struct {
+	MountPath string
+	Path      string
+	Field     string
+}
+
+// currentAPIKeyLocation returns where the secret api key is currently stored
+func (v *Vault) currentAPIKeyLocation() APIKeyLocation {
+	/* */ v.apiKeyLocationMutex.RLock()
+	defer v.apiKeyLocationMutex.RUnlock()
+
+	return v.apiKeyLocation
+}
+
+// SetAPIKeyLocation points us to a different kv-v2 secret or field for the
+// api key; the cached api key is no longer used since it came from the
+// previous location
+func (v *Vault) SetAPIKeyLocation(location APIKeyLocation) {
+	/* */ v.apiKeyLocationMutex.Lock()
+	defer v.apiKeyLocationMutex.Unlock()
+
+	v.apiKeyLocation = location
+}
+
+// APIKey is a specific version of the secret api key stored in kv-v2
+type APIKey struct {
+	Value       string
+	Version     int
+	CreatedTime time.Time
+
+	location APIKeyLocation         // where it was read from
+	fields   map[string]interface{} // all fields of this version, e.g. the username for http basic authentication
+}
+
+// fetchSecretAPIKey fetches the latest version of secret api key from kv-v2,
+// or the pinned version, if one is configured
+func (v *Vault) fetchSecretAPIKey(ctx context.Context) (APIKey, error) {
+	return v.fetchSecretAPIKeyVersion(ctx, v.parameters.apiKeyVersion)
+}
+
+// fetchSecretAPIKeyVersion fetches a specific version of secret api key from
+// kv-v2; version 0 refers to the latest version
+func (v *Vault) fetchSecretAPIKeyVersion(ctx context.Context, version int) (APIKey, error) {
 	log.Println("getting secret api key from vault")
 
-	secret, err := v.client.KVv2(v.parameters.apiKeyMountPath).Get(ctx, v.parameters.apiKeyPath)
+	var (
+		location = v.currentAPIKeyLocation()
+		secret   *vault.KVSecret
+		err      error
+	)
+
+	if version == 0 {
+		secret, err = v.client.KVv2(location.MountPath).Get(ctx, location.Path)
+	} else {
+		secret, err = v.client.KVv2(location.MountPath).GetVersion(ctx, location.Path, version)
+	}
+	if err != nil {
+		return APIKey{}, fmt.Errorf("unable to read secret: %w", err)
+	}
+
+	apiKeyString, err := secretStringField(secret.Data, location.Field)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	result := APIKey{Value: apiKeyString, location: location, fields: secret.Data}
+
+	if secret.VersionMetadata != nil {
+		result.Version = secret.VersionMetadata.Version
+		result.CreatedTime = secret.VersionMetadata.CreatedTime
+	}
+
+	log.Printf("getting secret api key from vault: success! (version %d)", result.Version)
+
+	return result, nil
+}
+
+// GetKVSecretField reads the latest version of the given kv-v2 secret and
+// returns one of its string fields
+func (v *Vault) GetKVSecretField(ctx context.Context, mountPath, path, field string) (string, error) {
+	log.Printf("getting %q secret from vault", path)
+
+	secret, err := v.client.KVv2(mountPath).Get(ctx, path)
 	if err != nil {
 		return "", fmt.Errorf("unable to read secret: %w", err)
 	}
 
-	apiKey, ok := secret.Data[v.parameters.apiKeyField]
-	if !ok {
-		return "", fmt.Errorf("the secret retrieved from vault is missing %q field", v.parameters.apiKeyField)
+	value, err := secretStringField(secret.Data, field)
+	if err != nil {
+		return "", err
 	}
 
-	apiKeyString, ok := apiKey.(string)
+	log.Printf("getting %q secret from vault: success!", path)
+
+	return value, nil
+}
+
+// secretStringField returns the given string field of a kv secret
+func secretStringField(data map[string]interface{}, field string) (string, error) {
+	value, ok := data[field]
 	if !ok {
-		return "", fmt.Errorf("unexpected secret key type for %q field", v.parameters.apiKeyField)
+		return "", fmt.Errorf("the secret retrieved from vault is missing %q field", field)
 	}
 
-	log.Println("getting secret api key from vault: success!")
+	valueString, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected secret key type for %q field", field)
+	}
 
-	return apiKeyString, nil
+	return valueString, nil
 }
 
 // GetDatabaseCredentials retrieves a new set of temporary database credentials
 func (v *Vault) GetDatabaseCredentials(ctx context.Context) (DatabaseCredentials, *vault.Secret, error) {
+	return v.getDatabaseCredentials(ctx, v.parameters.databaseCredentialsPath)
+}
+
+// RevokeLease revokes the given lease immediately instead of waiting for it
+// to expire; for database credentials this drops the database user. The lease
+// ID is passed in the path rather than in the body, so that policies can only
+// allow revoking the leases of specific secrets engines & roles.
+//
+// ref: https://www.vaultproject.io/api-docs/system/leases#revoke-lease
+func (v *Vault) RevokeLease(ctx context.Context, lease *vault.Secret) error {
+	log.Printf("revoking lease %q", lease.LeaseID)
+
+	if _, err := v.client.Logical().WriteWithContext(ctx, "sys/leases/revoke/"+lease.LeaseID, nil); err != nil {
+		return fmt.Errorf("unable to revoke lease: %w", err)
+	}
+
+	log.Printf("revoking lease %q: success!", lease.LeaseID)
+
+	return nil
+}
+
+func (v *Vault) getDatabaseCredentials(ctx context.Context, path string) (DatabaseCredentials, *vault.Secret, error) {
 	log.Println("getting temporary database credentials from vault")
 
-	lease, err := v.client.Logical().ReadWithContext(ctx, v.parameters.databaseCredentialsPath)
+	lease, err := v.client.Logical().ReadWithContext(ctx, path)
 	if err != nil {
 		return DatabaseCredentials{}, nil, fmt.Errorf("unable to read secret: %w", err)
 	}
@@ -0,0 +1,190 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// apiKeyCache holds the last good version of the secret api key, so that we
+// don't have to read it from Vault on every request. A cached api key which
+// was read from a different location (see SetAPIKeyLocation) is ignored.
+type apiKeyCache struct {
+	mutex     sync.RWMutex
+	apiKey    APIKey
+	cached    bool
+	checkedAt time.Time // the last time the cached version was confirmed to be the current one
+}
+
+func (c *apiKeyCache) get(location APIKeyLocation) (apiKey APIKey, checkedAt time.Time, ok bool) {
+	/* */ c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.apiKey, c.checkedAt, c.cached && c.apiKey.location == location
+}
+
+func (c *apiKeyCache) set(apiKey APIKey) {
+	/* */ c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.apiKey = apiKey
+	c.cached = true
+	c.checkedAt = time.Now()
+}
+
+// confirm marks the cached api key as current if it still has the given version
+func (c *apiKeyCache) confirm(location APIKeyLocation, version int) bool {
+	/* */ c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.cached || c.apiKey.location != location || c.apiKey.Version != version {
+		return false
+	}
+
+	c.checkedAt = time.Now()
+
+	return true
+}
+
+// GetSecretAPIKey returns the secret api key from kv-v2. The key is cached:
+// as long as the cached version has been confirmed to be the current one
+// within the cache TTL (normally by PeriodicallyRefreshAPIKey in the
+// background), it is returned without talking to Vault. If Vault cannot be
+// reached, the last good version keeps being served for a bounded time
+// (max staleness) so that a brief Vault outage does not fail our requests.
+func (v *Vault) GetSecretAPIKey(ctx context.Context) (APIKey, error) {
+	if v.parameters.apiKeyCacheTTL <= 0 {
+		return v.fetchSecretAPIKey(ctx) // caching is disabled
+	}
+
+	cached, checkedAt, ok := v.apiKeyCache.get(v.currentAPIKeyLocation())
+	if ok && time.Since(checkedAt) < v.parameters.apiKeyCacheTTL {
+		log.Printf("getting secret api key from cache: version %d", cached.Version)
+		return cached, nil
+	}
+
+	apiKey, err := v.refreshSecretAPIKey(ctx)
+	if err == nil {
+		return apiKey, nil
+	}
+
+	if ok && time.Since(checkedAt) < v.parameters.apiKeyCacheTTL+v.parameters.apiKeyCacheMaxStaleness {
+		log.Printf("api key cache: unable to refresh, serving cached version %d (last confirmed %s ago): %v", cached.Version, time.Since(checkedAt).Round(time.Second), err)
+		return cached, nil
+	}
+
+	return APIKey{}, err
+}
+
+// CachedSecretAPIKeyVersion reports the version of the currently cached api key
+func (v *Vault) CachedSecretAPIKeyVersion() (int, bool) {
+	apiKey, _, ok := v.apiKeyCache.get(v.currentAPIKeyLocation())
+
+	return apiKey.Version, ok
+}
+
+// refreshSecretAPIKey checks the kv-v2 metadata for the current version of
+// the api key and only reads the secret itself if the version has changed
+func (v *Vault) refreshSecretAPIKey(ctx context.Context) (APIKey, error) {
+	location := v.currentAPIKeyLocation()
+
+	if cached, _, ok := v.apiKeyCache.get(location); ok {
+		// a pinned version never changes, so there is nothing to check
+		current := v.parameters.apiKeyVersion
+
+		if current == 0 {
+			metadata, err := v.client.KVv2(location.MountPath).GetMetadata(ctx, location.Path)
+			if err != nil {
+				return APIKey{}, fmt.Errorf("unable to read secret metadata: %w", err)
+			}
+			current = metadata.CurrentVersion
+		}
+
+		if v.apiKeyCache.confirm(location, current) {
+			return cached, nil
+		}
+
+		log.Printf("api key cache: version %d is outdated; current version is %d", cached.Version, current)
+	}
+
+	apiKey, err := v.fetchSecretAPIKey(ctx)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	v.apiKeyCache.set(apiKey)
+
+	return apiKey, nil
+}
+
+// GetRotatedSecretAPIKey should be called when the secure service rejects
+// the given api key. It re-reads the newest version from Vault, bypassing
+// (and updating) the cache, and returns the single version worth retrying
+// with, if any:
+//   - the newest version, if it differs from the rejected one
+//   - otherwise, the version before it, if the newest version was created
+//     within the rotation grace period (i.e. the secure service might still
+//     only accept the previous version)
+//
+// Nothing is returned if a specific version of the api key is pinned.
+func (v *Vault) GetRotatedSecretAPIKey(ctx context.Context, rejected APIKey) (APIKey, bool, error) {
+	if v.parameters.apiKeyVersion != 0 {
+		return APIKey{}, false, nil
+	}
+
+	latest, err := v.fetchSecretAPIKey(ctx)
+	if err != nil {
+		return APIKey{}, false, err
+	}
+
+	v.apiKeyCache.set(latest)
+
+	if latest.Version != rejected.Version {
+		return latest, true, nil
+	}
+
+	previousVersion := latest.Version - 1
+
+	if previousVersion > 0 && time.Since(latest.CreatedTime) < v.parameters.apiKeyRotationGracePeriod {
+		previous, err := v.fetchSecretAPIKeyVersion(ctx, previousVersion)
+		if err != nil {
+			return APIKey{}, false, err
+		}
+
+		return previous, true, nil
+	}
+
+	return APIKey{}, false, nil
+}
+
+// PeriodicallyRefreshAPIKey keeps the cached api key up to date by checking
+// for a new version every cache TTL. It should be run as a goroutine; errors
+// are logged and the last good version is kept (see GetSecretAPIKey).
+func (v *Vault) PeriodicallyRefreshAPIKey(ctx context.Context) {
+	if v.parameters.apiKeyCacheTTL <= 0 {
+		return // caching is disabled
+	}
+
+	log.Println("api key cache refresh loop: begin")
+	defer log.Println("api key cache refresh loop: end")
+
+	ticker := time.NewTicker(v.parameters.apiKeyCacheTTL)
+	defer ticker.Stop()
+
+	for {
+		if _, err := v.refreshSecretAPIKey(ctx); err != nil {
+			log.Printf("api key cache: refresh error: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// GetSecretAPIKeyMetadata returns the kv-v2 metadata of the secret api key
+// (current & oldest version, max versions, etc.) without reading its value
+func (v *Vault) GetSecretAPIKeyMetadata(ctx context.Context) (*vault.KVMetadata, error) {
+	log.Println("getting secret api key metadata from vault")
+
+	location := v.currentAPIKeyLocation()
+
+	metadata, err := v.client.KVv2(location.MountPath).GetMetadata(ctx, location.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret metadata: %w", err)
+	}
+
+	log.Println("getting secret api key metadata from vault: success!")
+
+	return metadata, nil
+}
+
+// GetSecretAPIKeyVersions returns the metadata of every version of the secret
+// api key which is still retained by kv-v2, sorted by version
+func (v *Vault) GetSecretAPIKeyVersions(ctx context.Context) ([]vault.KVVersionMetadata, error) {
+	log.Println("getting secret api key versions from vault")
+
+	location := v.currentAPIKeyLocation()
+
+	versions, err := v.client.KVv2(location.MountPath).GetVersionsAsList(ctx, location.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret versions: %w", err)
+	}
+
+	log.Println("getting secret api key versions from vault: success!")
+
+	return versions, nil
+}
+
+// RollbackSecretAPIKey writes the data of an earlier version of the secret
+// api key as its newest version and returns the new version number. The
+// cache is refreshed right away, so that the rolled back key is used
+// immediately (unless a specific version is pinned).
+func (v *Vault) RollbackSecretAPIKey(ctx context.Context, toVersion int) (int, error) {
+	log.Printf("rolling back secret api key to version %d", toVersion)
+
+	location := v.currentAPIKeyLocation()
+
+	secret, err := v.client.KVv2(location.MountPath).Rollback(ctx, location.Path, toVersion)
+	if err != nil {
+		return 0, fmt.Errorf("unable to roll back secret: %w", err)
+	}
+
+	if secret.VersionMetadata == nil {
+		return 0, fmt.Errorf("no version metadata was returned after rollback")
+	}
+
+	log.Printf("rolling back secret api key to version %d: success! (new version %d)", toVersion, secret.VersionMetadata.Version)
+
+	if _, err := v.refreshSecretAPIKey(ctx); err != nil {
+		log.Printf("api key cache: refresh error: %v", err)
+	}
+
+	return secret.VersionMetadata.Version, nil
+}
+
+// ErrAPIKeyVersionConflict is returned when the secret api key was modified
+// by someone else while we were rotating it
+var ErrAPIKeyVersionConflict = errors.New("the api key was modified concurrently, please try again")
+
+// RotateSecretAPIKey writes a new value of the secret api key (keeping any
+// other fields of the secret intact) and returns the new version number. The
+// write uses check-and-set against the version we have read, so a concurrent
+// modification results in ErrAPIKeyVersionConflict instead of being silently
+// overwritten.
+func (v *Vault) RotateSecretAPIKey(ctx context.Context, newAPIKey string) (int, error) {
+	log.Println("rotating secret api key")
+
+	location := v.currentAPIKeyLocation()
+
+	kv := v.client.KVv2(location.MountPath)
+
+	current, err := kv.Get(ctx, location.Path)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read secret: %w", err)
+	}
+	if current.VersionMetadata == nil {
+		return 0, fmt.Errorf("no version metadata was returned for the current secret")
+	}
+
+	data := make(map[string]interface{}, len(current.Data)+1)
+	for field, value := range current.Data {
+		data[field] = value
+	}
+	data[location.Field] = newAPIKey
+
+	secret, err := kv.Put(ctx, location.Path, data, vault.WithCheckAndSet(current.VersionMetadata.Version))
+	if err != nil {
+		if isCheckAndSetError(err) {
+			return 0, ErrAPIKeyVersionConflict
+		}
+		return 0, fmt.Errorf("unable to write secret: %w", err)
+	}
+	if secret.VersionMetadata == nil {
+		return 0, fmt.Errorf("no version metadata was returned after rotation")
+	}
+
+	log.Printf("rotating secret api key: success! (version %d -> %d)", current.VersionMetadata.Version, secret.VersionMetadata.Version)
+
+	if _, err := v.refreshSecretAPIKey(ctx); err != nil {
+		log.Printf("api key cache: refresh error: %v", err)
+	}
+
+	return secret.VersionMetadata.Version, nil
+}
+
+// isCheckAndSetError checks whether a kv-v2 write was rejected because the
+// check-and-set version did not match the current version of the secret
+func isCheckAndSetError(err error) bool {
+	var responseError *vault.ResponseError
+	if !errors.As(err, &responseError) || responseError.StatusCode != http.StatusBadRequest {
+		return false
+	}
+
+	for _, e := range responseError.Errors {
+		if strings.Contains(e, "check-and-set") {
+			return true
+		}
+	}
+
+	return false
+}
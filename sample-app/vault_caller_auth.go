@@ -0,0 +1,111 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// LookupCallerToken verifies a Vault token presented by a caller of our API.
+// The token is looked up using the token itself (auth/token/lookup-self),
+// which every valid token is allowed to do through Vault's default policy,
+// so our own token does not need any extra permissions.
+func (v *Vault) LookupCallerToken(ctx context.Context, token string) (*vault.Secret, error) {
+	client, err := v.client.Clone() // does not copy our own token
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize vault client: %w", err)
+	}
+
+	client.SetToken(token)
+
+	secret, err := client.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up caller token: %w", err)
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("no token info was returned after lookup")
+	}
+
+	return secret, nil
+}
+
+// LookupEntityGroups returns the names of the identity groups the given
+// entity is a member of (directly or through a parent group)
+func (v *Vault) LookupEntityGroups(ctx context.Context, entityID string) ([]string, error) {
+	entity, err := v.client.Logical().ReadWithContext(ctx, "identity/entity/id/"+url.PathEscape(entityID))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read identity entity: %w", err)
+	}
+	if entity == nil || entity.Data == nil {
+		return nil, fmt.Errorf("identity entity %q: %w", entityID, ErrVaultNotFound)
+	}
+
+	groupIDs, _ := entity.Data["group_ids"].([]interface{})
+
+	groups := make([]string, 0, len(groupIDs))
+	for _, id := range groupIDs {
+		groupID, ok := id.(string)
+		if !ok {
+			continue
+		}
+
+		group, err := v.client.Logical().ReadWithContext(ctx, "identity/group/id/"+url.PathEscape(groupID))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read identity group: %w", err)
+		}
+		if group == nil || group.Data == nil {
+			continue // removed in the meantime
+		}
+
+		if name, ok := group.Data["name"].(string); ok {
+			groups = append(groups, name)
+		}
+	}
+
+	return groups, nil
+}
+
+// JSONWebKey is a public key used by Vault to sign identity tokens
+type JSONWebKey struct {
+	KeyID     string `json:"kid"`
+	KeyType   string `json:"kty"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+}
+
+// GetIdentityTokenKeys returns the public keys which can be used to verify
+// identity tokens issued by Vault (identity/oidc/.well-known/keys). This
+// endpoint is unauthenticated, so no extra permissions are needed.
+func (v *Vault) GetIdentityTokenKeys(ctx context.Context) ([]JSONWebKey, error) {
+	log.Println("getting identity token keys from vault")
+
+	response, err := v.client.Logical().ReadRawWithContext(ctx, "identity/oidc/.well-known/keys")
+	if response != nil {
+		defer response.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read identity token keys: %w", err)
+	}
+
+	var keySet struct {
+		Keys []JSONWebKey `json:"keys"`
+	}
+
+	if err := response.DecodeJSON(&keySet); err != nil {
+		return nil, fmt.Errorf("malformed identity token keys returned: %w", err)
+	}
+
+	log.Printf("getting identity token keys from vault: success! (%d keys)", len(keySet.Keys))
+
+	return keySet.Keys, nil
+}
@@ -0,0 +1,21 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// GetCapabilities returns the capabilities our token has on the given path,
+// as granted by its policies (sys/capabilities-self), e.g. ["read", "update"];
+// ["deny"] means none at all
+func (v *Vault) GetCapabilities(ctx context.Context, path string) ([]string, error) {
+	capabilities, err := v.client.Sys().CapabilitiesSelfWithContext(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up capabilities: %w", err)
+	}
+
+	return capabilities, nil
+}
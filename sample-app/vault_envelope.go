@@ -0,0 +1,229 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Envelope is a payload encrypted locally (AES-256-GCM) with a data key
+// generated by the transit secrets engine. The data key itself is only ever
+// stored wrapped (encrypted) by the transit key, alongside the ciphertext, so
+// the envelope is self-contained and can be safely stored elsewhere.
+type Envelope struct {
+	WrappedKey string `json:"wrapped_key"` // e.g. "vault:v1:..."
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// EnvelopeEncrypt encrypts the given plaintext with a new data key from the
+// named transit key. Unlike TransitEncrypt, the payload itself never travels
+// to Vault, which makes this suitable for large payloads. The optional
+// associated data is authenticated but not encrypted; the same value must be
+// passed to EnvelopeDecrypt.
+//
+// ref: https://www.vaultproject.io/api-docs/secret/transit#generate-data-key
+func (v *Vault) EnvelopeEncrypt(ctx context.Context, keyName string, plaintext, associatedData []byte) (Envelope, error) {
+	wrappedKey, dataKey, err := v.generateDataKey(ctx, keyName)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	// the data key is unique to this envelope, so a random nonce is safe
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return Envelope{}, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	aead, err := newAESGCM(dataKey)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{
+		WrappedKey: wrappedKey,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, envelopeAssociatedData(wrappedKey, associatedData)),
+	}, nil
+}
+
+// EnvelopeDecrypt decrypts an envelope produced by EnvelopeEncrypt. The data
+// key is unwrapped through Vault (transit decrypt) unless it is found in the
+// data key cache.
+func (v *Vault) EnvelopeDecrypt(ctx context.Context, keyName string, envelope Envelope, associatedData []byte) ([]byte, error) {
+	dataKey, err := v.unwrapDataKey(ctx, keyName, envelope.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAESGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(envelope.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid envelope nonce size %d", len(envelope.Nonce))
+	}
+
+	plaintext, err := aead.Open(nil, envelope.Nonce, envelope.Ciphertext, envelopeAssociatedData(envelope.WrappedKey, associatedData))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt envelope: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// generateDataKey asks transit for a new 256-bit data key in its wrapped form
+// and unwraps it the same way EnvelopeDecrypt does, so the unwrapped key is
+// cached for subsequent decryption
+func (v *Vault) generateDataKey(ctx context.Context, keyName string) (string, []byte, error) {
+	log.Printf("generating data key with %q transit key", keyName)
+
+	path := fmt.Sprintf("%s/datakey/wrapped/%s", v.parameters.transitMountPath, keyName)
+
+	secret, err := v.client.Logical().WriteWithContext(ctx, path, map[string]interface{}{
+		"bits": 256,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to generate data key: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return "", nil, fmt.Errorf("no data was returned from %q", path)
+	}
+
+	wrappedKey, ok := secret.Data["ciphertext"].(string)
+	if !ok {
+		return "", nil, fmt.Errorf("unexpected data key ciphertext type returned from %q", path)
+	}
+
+	dataKey, err := v.unwrapDataKey(ctx, keyName, wrappedKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	log.Printf("generating data key with %q transit key: success!", keyName)
+
+	return wrappedKey, dataKey, nil
+}
+
+// unwrapDataKey returns the plaintext of the given wrapped data key, from the
+// cache if possible
+func (v *Vault) unwrapDataKey(ctx context.Context, keyName string, wrappedKey string) ([]byte, error) {
+	cacheKey := keyName + ":" + wrappedKey
+
+	if dataKey, ok := v.dataKeyCache.get(cacheKey); ok {
+		return dataKey, nil
+	}
+
+	results, err := v.TransitDecryptBatch(ctx, keyName, []TransitInput{{Ciphertext: wrappedKey}})
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap data key: %w", err)
+	}
+	if results[0].Error != "" {
+		return nil, fmt.Errorf("unable to unwrap data key: %s", results[0].Error)
+	}
+
+	v.dataKeyCache.add(cacheKey, results[0].Plaintext)
+
+	return results[0].Plaintext, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// envelopeAssociatedData binds the ciphertext to its wrapped key, so that the
+// wrapped key of an envelope cannot be swapped for another one
+func envelopeAssociatedData(wrappedKey string, associatedData []byte) []byte {
+	return append([]byte(wrappedKey+"\x00"), associatedData...)
+}
+
+// dataKeyCache is a size-bounded LRU cache of unwrapped data keys whose
+// entries also expire after a TTL, which limits both the number of plaintext
+// keys held in memory and how long a key stays usable after being cached
+type dataKeyCache struct {
+	size int
+	ttl  time.Duration
+
+	mutex   sync.Mutex
+	order   *list.List               // most recently used first
+	entries map[string]*list.Element // => *dataKeyCacheEntry
+}
+
+type dataKeyCacheEntry struct {
+	cacheKey  string
+	dataKey   []byte
+	expiresAt time.Time
+}
+
+func newDataKeyCache(size int, ttl time.Duration) *dataKeyCache {
+	return &dataKeyCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *dataKeyCache) get(cacheKey string) ([]byte, bool) {
+	/* */ c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[cacheKey]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*dataKeyCacheEntry)
+
+	if time.Now().After(entry.expiresAt) {
+		c.remove(element)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+
+	return entry.dataKey, true
+}
+
+func (c *dataKeyCache) add(cacheKey string, dataKey []byte) {
+	/* */ c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.size <= 0 || c.ttl <= 0 {
+		return // caching is disabled
+	}
+
+	if element, ok := c.entries[cacheKey]; ok {
+		c.remove(element)
+	}
+
+	c.entries[cacheKey] = c.order.PushFront(&dataKeyCacheEntry{
+		cacheKey:  cacheKey,
+		dataKey:   dataKey,
+		expiresAt: time.Now().Add(c.ttl),
+	})
+
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *dataKeyCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*dataKeyCacheEntry).cacheKey)
+}
@@ -0,0 +1,230 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDataKeys mimics the datakey & decrypt endpoints of the transit secrets
+// engine: a wrapped data key is simply "vault:v1:" followed by the base64 of
+// the data key itself; unwraps counts the decrypt requests
+func fakeDataKeys(t *testing.T, unwraps *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]interface{}
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/datakey/wrapped/app-data"):
+			dataKey := make([]byte, 32)
+			if _, err := rand.Read(dataKey); err != nil {
+				t.Errorf("unable to generate a data key: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			data = map[string]interface{}{"ciphertext": "vault:v1:" + base64.StdEncoding.EncodeToString(dataKey)}
+
+		case strings.HasSuffix(r.URL.Path, "/decrypt/app-data"):
+			atomic.AddInt32(unwraps, 1)
+
+			var request struct {
+				BatchInput []struct {
+					Ciphertext string `json:"ciphertext"`
+				} `json:"batch_input"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				t.Errorf("malformed request: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			results := make([]map[string]interface{}, 0, len(request.BatchInput))
+			for _, item := range request.BatchInput {
+				if plaintext, ok := strings.CutPrefix(item.Ciphertext, "vault:v1:"); ok {
+					results = append(results, map[string]interface{}{"plaintext": plaintext})
+				} else {
+					results = append(results, map[string]interface{}{"error": "invalid ciphertext: no prefix"})
+				}
+			}
+			data = map[string]interface{}{"batch_results": results}
+
+		default:
+			t.Errorf("unexpected request to %q", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	})
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	var unwraps int32
+
+	v := newTestVault(t, fakeDataKeys(t, &unwraps))
+	v.dataKeyCache = newDataKeyCache(10, time.Minute)
+
+	plaintext := []byte("a payload too large to send to vault")
+
+	envelope, err := v.EnvelopeEncrypt(context.Background(), "app-data", plaintext, []byte("customer-1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if bytes.Contains(envelope.Ciphertext, plaintext) {
+		t.Error("the envelope contains the plaintext")
+	}
+
+	decrypted, err := v.EnvelopeDecrypt(context.Background(), "app-data", envelope, []byte("customer-1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("expected %q, got %q", plaintext, decrypted)
+	}
+
+	// the data key was unwrapped once when it was generated, then cached
+	if n := atomic.LoadInt32(&unwraps); n != 1 {
+		t.Errorf("expected the data key to be unwrapped once, got %d", n)
+	}
+}
+
+func TestEnvelopeDecryptTampered(t *testing.T) {
+	var unwraps int32
+
+	v := newTestVault(t, fakeDataKeys(t, &unwraps))
+	v.dataKeyCache = newDataKeyCache(10, time.Minute)
+
+	envelope, err := v.EnvelopeEncrypt(context.Background(), "app-data", []byte("payload"), []byte("customer-1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	other, err := v.EnvelopeEncrypt(context.Background(), "app-data", []byte("payload"), []byte("customer-1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		tamper         func(e Envelope) Envelope
+		associatedData string
+	}{
+		{
+			name: "flipped ciphertext bit",
+			tamper: func(e Envelope) Envelope {
+				e.Ciphertext = append([]byte(nil), e.Ciphertext...)
+				e.Ciphertext[0] ^= 1
+				return e
+			},
+			associatedData: "customer-1",
+		},
+		{
+			name: "truncated nonce",
+			tamper: func(e Envelope) Envelope {
+				e.Nonce = e.Nonce[:8]
+				return e
+			},
+			associatedData: "customer-1",
+		},
+		{
+			name: "swapped wrapped key",
+			tamper: func(e Envelope) Envelope {
+				e.WrappedKey = other.WrappedKey
+				return e
+			},
+			associatedData: "customer-1",
+		},
+		{
+			name: "unwrappable wrapped key",
+			tamper: func(e Envelope) Envelope {
+				e.WrappedKey = "not-a-ciphertext"
+				return e
+			},
+			associatedData: "customer-1",
+		},
+		{
+			name:           "different associated data",
+			tamper:         func(e Envelope) Envelope { return e },
+			associatedData: "customer-2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := v.EnvelopeDecrypt(context.Background(), "app-data", tt.tamper(envelope), []byte(tt.associatedData)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestDataKeyCacheEviction(t *testing.T) {
+	cache := newDataKeyCache(2, time.Minute)
+
+	cache.add("a", []byte("key-a"))
+	cache.add("b", []byte("key-b"))
+
+	// "a" becomes the most recently used entry, so "b" is evicted next
+	if _, ok := cache.get("a"); !ok {
+		t.Fatal(`expected "a" to be cached`)
+	}
+
+	cache.add("c", []byte("key-c"))
+
+	if _, ok := cache.get("b"); ok {
+		t.Error(`expected "b" to be evicted`)
+	}
+
+	for _, cacheKey := range []string{"a", "c"} {
+		if _, ok := cache.get(cacheKey); !ok {
+			t.Errorf("expected %q to be cached", cacheKey)
+		}
+	}
+
+	if len(cache.entries) != 2 || cache.order.Len() != 2 {
+		t.Errorf("expected 2 entries, got %d (%d in order)", len(cache.entries), cache.order.Len())
+	}
+}
+
+func TestDataKeyCacheExpiry(t *testing.T) {
+	cache := newDataKeyCache(2, time.Minute)
+
+	cache.add("a", []byte("key-a"))
+	cache.add("b", []byte("key-b"))
+
+	cache.entries["a"].Value.(*dataKeyCacheEntry).expiresAt = time.Now().Add(-time.Second)
+
+	if _, ok := cache.get("a"); ok {
+		t.Error(`expected "a" to have expired`)
+	}
+
+	if _, ok := cache.entries["a"]; ok {
+		t.Error(`expected "a" to be removed once expired`)
+	}
+
+	if dataKey, ok := cache.get("b"); !ok || string(dataKey) != "key-b" {
+		t.Errorf(`expected "b" to be cached, got %q`, dataKey)
+	}
+}
+
+func TestDataKeyCacheDisabled(t *testing.T) {
+	for _, cache := range []*dataKeyCache{newDataKeyCache(0, time.Minute), newDataKeyCache(2, 0)} {
+		cache.add("a", []byte("key-a"))
+
+		if _, ok := cache.get("a"); ok {
+			t.Errorf("expected nothing to be cached (size %d, ttl %s)", cache.size, cache.ttl)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// The kinds of Vault errors callers may want to handle differently; see
+// vaultErrorKind. Since the Vault methods wrap the original errors, these can
+// be matched anywhere up the chain.
+var (
+	ErrVaultNotFound       = errors.New("vault: not found")
+	ErrVaultForbidden      = errors.New("vault: permission denied")
+	ErrVaultSealed         = errors.New("vault: sealed")
+	ErrVaultUnavailable    = errors.New("vault: unavailable")
+	ErrVaultRateLimited    = errors.New("vault: rate limited")
+	ErrVaultInvalidRequest = errors.New("vault: invalid request")
+)
+
+// vaultErrorKind classifies an error returned (possibly wrapped) by the vault
+// client into one of the ErrVault* errors. It returns nil if the error did not
+// originate from Vault or does not fit any of them.
+func vaultErrorKind(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, vault.ErrSecretNotFound) {
+		return ErrVaultNotFound
+	}
+
+	var responseError *vault.ResponseError
+	if errors.As(err, &responseError) {
+		switch code := responseError.StatusCode; {
+		case code == http.StatusNotFound:
+			return ErrVaultNotFound
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return ErrVaultForbidden
+		case code == http.StatusTooManyRequests:
+			return ErrVaultRateLimited
+		case code == http.StatusServiceUnavailable && isSealedError(responseError):
+			return ErrVaultSealed
+		case code >= http.StatusInternalServerError:
+			return ErrVaultUnavailable
+		case code == http.StatusBadRequest:
+			return ErrVaultInvalidRequest
+		}
+		return nil
+	}
+
+	// the request never reached vault or no response came back in time
+	var transportError *vaultTransportError
+	if errors.As(err, &transportError) {
+		return ErrVaultUnavailable
+	}
+
+	return nil
+}
+
+func isSealedError(responseError *vault.ResponseError) bool {
+	for _, e := range responseError.Errors {
+		if strings.Contains(strings.ToLower(e), "sealed") {
+			return true
+		}
+	}
+	return false
+}
+
+// vaultTransport marks the errors of requests which never got a response from
+// Vault (connection refused, timeouts, etc.), so that they can be told apart
+// from errors of other services (e.g. the database) which look the same
+type vaultTransport struct {
+	http.RoundTripper
+}
+
+type vaultTransportError struct {
+	err error
+}
+
+func (e *vaultTransportError) Error() string { return e.err.Error() }
+func (e *vaultTransportError) Unwrap() error { return e.err }
+
+func (t *vaultTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.RoundTripper.RoundTrip(request)
+	if err != nil {
+		return nil, &vaultTransportError{err: err}
+	}
+	return response, nil
+}
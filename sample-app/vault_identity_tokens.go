@@ -0,0 +1,53 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+// MintIdentityToken requests a signed identity token for our own entity from
+// the given role (identity/oidc/token/<role>) and returns it along with its
+// expiration time. The token's audience is the role's client id.
+func (v *Vault) MintIdentityToken(ctx context.Context, role string) (string, time.Time, error) {
+	log.Printf("minting identity token with role %q", role)
+
+	issuedAt := time.Now()
+
+	secret, err := v.client.Logical().ReadWithContext(ctx, "identity/oidc/token/"+url.PathEscape(role))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to mint identity token: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return "", time.Time{}, fmt.Errorf("no identity token was returned")
+	}
+
+	b, err := json.Marshal(secret.Data)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("malformed identity token returned: %w", err)
+	}
+
+	var response struct {
+		Token string `json:"token"`
+		TTL   int64  `json:"ttl"` // seconds
+	}
+
+	if err := json.Unmarshal(b, &response); err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to unmarshal identity token: %w", err)
+	}
+	if response.Token == "" {
+		return "", time.Time{}, fmt.Errorf("no identity token was returned")
+	}
+
+	ttl := time.Duration(response.TTL) * time.Second
+
+	log.Printf("minting identity token with role %q: success! (valid for %s)", role, ttl)
+
+	return response.Token, issuedAt.Add(ttl), nil
+}
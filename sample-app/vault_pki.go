@@ -0,0 +1,216 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertificateParameters describe a certificate to be issued by the pki
+// secrets engine
+type CertificateParameters struct {
+	role       string // the pki role which constrains the issued certificates
+	commonName string
+	altNames   []string
+	ttl        time.Duration
+}
+
+// Certificate is a TLS certificate (with its private key) issued by Vault's
+// pki secrets engine. It is meant to be plugged into a tls.Config through
+// GetCertificate (servers) or GetClientCertificate (clients) and kept fresh by
+// PeriodicallyRenewCertificate, which swaps in a newly issued certificate
+// before the current one expires. Since the certificate is looked up on every
+// handshake, existing connections are not affected by the swap.
+type Certificate struct {
+	parameters CertificateParameters
+
+	mutex   sync.RWMutex
+	current *tls.Certificate
+}
+
+// pkiIssueResponse is the relevant subset of the pki "issue" endpoint response
+type pkiIssueResponse struct {
+	Certificate  string   `json:"certificate"`
+	PrivateKey   string   `json:"private_key"`
+	IssuingCA    string   `json:"issuing_ca"`
+	CAChain      []string `json:"ca_chain"`
+	SerialNumber string   `json:"serial_number"`
+}
+
+// NewCertificate issues the first certificate with the given parameters
+func (v *Vault) NewCertificate(ctx context.Context, parameters CertificateParameters) (*Certificate, error) {
+	certificate := &Certificate{
+		parameters: parameters,
+	}
+
+	current, err := v.issueCertificate(ctx, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate.set(current)
+
+	return certificate, nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate by servers
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.get(), nil
+}
+
+// GetClientCertificate can be used as tls.Config.GetClientCertificate by clients
+func (c *Certificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.get(), nil
+}
+
+func (c *Certificate) get() *tls.Certificate {
+	/* */ c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.current
+}
+
+func (c *Certificate) set(current *tls.Certificate) {
+	/* */ c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.current = current
+}
+
+// renewAt returns the time when the current certificate should be replaced:
+// once two thirds of its lifetime have passed
+func (c *Certificate) renewAt() time.Time {
+	leaf := c.get().Leaf
+
+	return leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3)
+}
+
+// PeriodicallyRenewCertificate re-issues the given certificate before it
+// expires and hot-swaps it. It should be run as a goroutine. Errors are
+// logged and retried since the current certificate remains valid for a while.
+func (v *Vault) PeriodicallyRenewCertificate(ctx context.Context, certificate *Certificate) {
+	/* */ log.Printf("renew %q certificate loop: begin", certificate.parameters.commonName)
+	defer log.Printf("renew %q certificate loop: end", certificate.parameters.commonName)
+
+	const retryInterval = 30 * time.Second
+
+	wait := time.Until(certificate.renewAt())
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		renewed, err := v.issueCertificate(ctx, certificate.parameters)
+		if err != nil {
+			log.Printf("certificate renew error (will retry in %s): %v", retryInterval, err)
+			wait = retryInterval
+			continue
+		}
+
+		certificate.set(renewed)
+
+		wait = time.Until(certificate.renewAt())
+	}
+}
+
+// GetCACertificates returns a pool containing the CA certificate of the pki
+// secrets engine, which can be used to verify certificates issued by it
+func (v *Vault) GetCACertificates(ctx context.Context) (*x509.CertPool, error) {
+	log.Println("getting ca certificate from vault pki")
+
+	path := fmt.Sprintf("%s/cert/ca", v.parameters.pkiMountPath)
+
+	secret, err := v.client.Logical().ReadWithContext(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ca certificate: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("no data was returned from %q", path)
+	}
+
+	ca, ok := secret.Data["certificate"].(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected ca certificate type returned from %q", path)
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM([]byte(ca)) {
+		return nil, fmt.Errorf("unable to parse ca certificate returned from %q", path)
+	}
+
+	log.Println("getting ca certificate from vault pki: success!")
+
+	return pool, nil
+}
+
+// issueCertificate requests a new certificate & private key from the pki
+// secrets engine; the private key is generated by Vault and never stored
+//
+// ref: https://www.vaultproject.io/api-docs/secret/pki#generate-certificate-and-key
+func (v *Vault) issueCertificate(ctx context.Context, parameters CertificateParameters) (*tls.Certificate, error) {
+	log.Printf("issuing %q certificate from vault pki", parameters.commonName)
+
+	path := fmt.Sprintf("%s/issue/%s", v.parameters.pkiMountPath, parameters.role)
+
+	data := map[string]interface{}{
+		"common_name": parameters.commonName,
+	}
+	if len(parameters.altNames) != 0 {
+		data["alt_names"] = strings.Join(parameters.altNames, ",")
+	}
+	if parameters.ttl != 0 {
+		data["ttl"] = parameters.ttl.String()
+	}
+
+	secret, err := v.client.Logical().WriteWithContext(ctx, path, data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to issue certificate: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("no data was returned from %q", path)
+	}
+
+	b, err := json.Marshal(secret.Data)
+	if err != nil {
+		return nil, fmt.Errorf("malformed certificate returned: %w", err)
+	}
+
+	var response pkiIssueResponse
+
+	if err := json.Unmarshal(b, &response); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal certificate: %w", err)
+	}
+
+	// the leaf certificate followed by its issuing chain
+	chain := response.Certificate
+	for _, ca := range response.CAChain {
+		chain += "\n" + ca
+	}
+
+	certificate, err := tls.X509KeyPair([]byte(chain), []byte(response.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse certificate: %w", err)
+	}
+
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse leaf certificate: %w", err)
+	}
+
+	log.Printf("issuing %q certificate from vault pki: success! (serial %s, expires %s)", parameters.commonName, response.SerialNumber, certificate.Leaf.NotAfter.Format(time.RFC3339))
+
+	return &certificate, nil
+}
@@ -26,12 +26,15 @@ import (
 // this which are outside the scope of this code sample.
 //
 // ref: https://www.vaultproject.io/docs/enterprise/consistency#vault-1-7-mitigations
+//
+// Once ctx is done, the current database credentials lease (which may have
+// been replaced along the way) is returned, so that it can be revoked.
 func (v *Vault) PeriodicallyRenewLeases(
 	ctx context.Context,
 	authToken *vault.Secret,
 	databaseCredentialsLease *vault.Secret,
 	databaseReconnectFunc func(ctx context.Context, credentials DatabaseCredentials) error,
-) {
+) *vault.Secret {
 	/* */ log.Println("renew / recreate secrets loop: begin")
 	defer log.Println("renew / recreate secrets loop: end")
 
@@ -45,7 +48,7 @@ func (v *Vault) PeriodicallyRenewLeases(
 		}
 
 		if renewed&exitRequested != 0 {
-			return
+			return currentDatabaseCredentialsLease
 		}
 
 		if renewed&expiringAuthToken != 0 {
@@ -59,8 +62,12 @@ func (v *Vault) PeriodicallyRenewLeases(
 			currentAuthToken = authToken
 		}
 
-		if renewed&expiringDatabaseCredentialsLease != 0 {
-			log.Printf("database credentials: can no longer be renewed; will fetch new credentials & reconnect")
+		if renewed&(expiringDatabaseCredentialsLease|rejectedDatabaseCredentials) != 0 {
+			if renewed&rejectedDatabaseCredentials != 0 {
+				log.Printf("database credentials: rejected by the database; will fetch new credentials & reconnect")
+			} else {
+				log.Printf("database credentials: can no longer be renewed; will fetch new credentials & reconnect")
+			}
 
 			databaseCredentials, databaseCredentialsLease, err := v.GetDatabaseCredentials(ctx)
 			if err != nil {
@@ -72,6 +79,10 @@ func (v *Vault) PeriodicallyRenewLeases(
 			}
 
 			currentDatabaseCredentialsLease = databaseCredentialsLease
+
+			// a refresh requested while this one was in progress was about the
+			// credentials which have just been replaced
+			v.discardDatabaseCredentialsRefreshRequest()
 		}
 	}
 }
@@ -84,8 +95,32 @@ const (
 	exitRequested
 	expiringAuthToken                // will be revoked soon
 	expiringDatabaseCredentialsLease // will be revoked soon
+	rejectedDatabaseCredentials      // no longer accepted by the database
 )
 
+// RequestDatabaseCredentialsRefresh asks the renewal loop to fetch new
+// database credentials & reconnect right away, without waiting for the
+// current lease to expire. It does not block; multiple requests made before
+// the loop gets to them are coalesced into a single refresh.
+func (v *Vault) RequestDatabaseCredentialsRefresh() {
+	select {
+	case v.databaseCredentialsRefreshCh <- struct{}{}:
+	default: // a refresh has already been requested
+	}
+}
+
+// discardDatabaseCredentialsRefreshRequest drops a pending refresh request, if
+// any. Requests are only made after a query has failed on the connection it
+// observed, and requests made once the connection has been replaced are not
+// made at all (see Database.waitForNewCredentials), so after a reconnect any
+// pending request is stale.
+func (v *Vault) discardDatabaseCredentialsRefreshRequest() {
+	select {
+	case <-v.databaseCredentialsRefreshCh:
+	default:
+	}
+}
+
 // renewLeases is a blocking helper function that uses LifetimeWatcher
 // instances to periodically renew the given secrets when they are close to
 // their 'token_ttl' expiration times until one of the secrets is close to its
@@ -134,6 +169,11 @@ func (v *Vault) renewLeases(ctx context.Context, authToken, databaseCredentialsL
 		case err := <-databaseCredentialsWatcher.DoneCh():
 			return expiringDatabaseCredentialsLease, err
 
+		// The database rejected the current credentials before the lease
+		// expired (e.g. it was revoked early); see RequestDatabaseCredentialsRefresh
+		case <-v.databaseCredentialsRefreshCh:
+			return rejectedDatabaseCredentials, nil
+
 		// RenewCh is a channel that receives a message when a successful
 		// renewal takes place and includes metadata about the renewal.
 		case info := <-authTokenWatcher.RenewCh():
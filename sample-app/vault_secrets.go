@@ -0,0 +1,339 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// namedSecretRetryInterval is how long the refresh loops wait before trying
+// again when a named secret could not be read
+const namedSecretRetryInterval = 10 * time.Second
+
+// namedSecrets holds the current values (& leases) of the secrets declared in
+// the config file; secrets with the "always" refresh policy are not kept
+type namedSecrets struct {
+	mutex  sync.RWMutex
+	values map[string]SecretValue
+	leases map[string]*vault.Secret
+}
+
+func (s *namedSecrets) get(name string) (SecretValue, bool) {
+	/* */ s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	value, ok := s.values[name]
+
+	return value, ok
+}
+
+func (s *namedSecrets) lease(name string) (*vault.Secret, bool) {
+	/* */ s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	lease, ok := s.leases[name]
+
+	return lease, ok
+}
+
+func (s *namedSecrets) currentLeases() []*vault.Secret {
+	/* */ s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	leases := make([]*vault.Secret, 0, len(s.leases))
+	for _, lease := range s.leases {
+		leases = append(leases, lease)
+	}
+
+	return leases
+}
+
+func (s *namedSecrets) set(name string, value SecretValue, lease *vault.Secret) {
+	/* */ s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.values == nil {
+		s.values = make(map[string]SecretValue)
+		s.leases = make(map[string]*vault.Secret)
+	}
+
+	s.values[name] = value
+
+	if lease != nil {
+		s.leases[name] = lease
+	}
+}
+
+// Secret returns the current value of a secret declared in the "secrets"
+// section of the config file (see SecretDefinition), e.g.
+//
+//	secret, err := v.Secret(ctx, "payments-api-key")
+//	...
+//	apiKey, err := secret.String("api-key-field")
+//
+// Depending on the secret's refresh policy, the value is either read from
+// vault right away or the one kept up to date by PeriodicallyRefreshSecrets.
+func (v *Vault) Secret(ctx context.Context, name string) (SecretValue, error) {
+	definition, ok := v.parameters.secrets[name]
+	if !ok {
+		return SecretValue{}, fmt.Errorf("%w: %q", ErrSecretNotDeclared, name)
+	}
+
+	if definition.Refresh != SecretRefreshAlways {
+		if value, ok := v.namedSecrets.get(name); ok {
+			return value.clone(), nil
+		}
+	}
+
+	value, err := v.refreshSecret(ctx, name, definition)
+	if err != nil {
+		return SecretValue{}, err
+	}
+
+	return value.clone(), nil
+}
+
+// LoadSecrets reads the declared secrets which are kept in memory, so that
+// misconfigured secrets are noticed at startup rather than on first use
+func (v *Vault) LoadSecrets(ctx context.Context) error {
+	for _, name := range v.secretNames() {
+		definition := v.parameters.secrets[name]
+
+		if definition.Refresh == SecretRefreshAlways {
+			continue
+		}
+
+		if _, err := v.refreshSecret(ctx, name, definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PeriodicallyRefreshSecrets keeps the declared secrets up to date according
+// to their refresh policies: secrets with a refresh interval are re-read at
+// that interval, and leased secrets are renewed & re-read once their lease
+// can no longer be renewed. It should be run as a goroutine; errors are
+// logged, the last good value is kept & the read is retried.
+func (v *Vault) PeriodicallyRefreshSecrets(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, name := range v.secretNames() {
+		definition := v.parameters.secrets[name]
+
+		switch {
+		case definition.refreshInterval > 0:
+			wg.Add(1)
+			go func(name string) {
+				v.periodicallyRereadSecret(ctx, name, definition)
+				wg.Done()
+			}(name)
+
+		case definition.Refresh == SecretRefreshLease:
+			wg.Add(1)
+			go func(name string) {
+				v.periodicallyRenewSecret(ctx, name, definition)
+				wg.Done()
+			}(name)
+		}
+	}
+
+	wg.Wait()
+}
+
+func (v *Vault) periodicallyRereadSecret(ctx context.Context, name string, definition SecretDefinition) {
+	log.Printf("%q secret refresh loop: begin", name)
+	defer log.Printf("%q secret refresh loop: end", name)
+
+	ticker := time.NewTicker(definition.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := v.refreshSecret(ctx, name, definition); err != nil {
+			log.Printf("%q secret: refresh error; keeping the current value: %v", name, err)
+		}
+	}
+}
+
+func (v *Vault) periodicallyRenewSecret(ctx context.Context, name string, definition SecretDefinition) {
+	log.Printf("%q secret renew loop: begin", name)
+	defer log.Printf("%q secret renew loop: end", name)
+
+	for {
+		if lease, ok := v.namedSecrets.lease(name); ok {
+			if !v.renewSecretLease(ctx, name, lease) {
+				return // exit requested
+			}
+			log.Printf("%q secret: can no longer be renewed; will read it again", name)
+		}
+
+		for {
+			_, err := v.refreshSecret(ctx, name, definition)
+			if err == nil {
+				break
+			}
+
+			log.Printf("%q secret: read error; retrying in %s: %v", name, namedSecretRetryInterval, err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(namedSecretRetryInterval):
+			}
+		}
+	}
+}
+
+// renewSecretLease renews the lease until it can no longer be renewed, in
+// which case it returns true, or until ctx is done
+func (v *Vault) renewSecretLease(ctx context.Context, name string, lease *vault.Secret) bool {
+	watcher, err := v.client.NewLifetimeWatcher(&vault.LifetimeWatcherInput{
+		Secret: lease,
+	})
+	if err != nil {
+		log.Printf("%q secret: unable to initialize lifetime watcher: %v", name, err)
+		return true
+	}
+
+	go watcher.Start()
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				log.Printf("%q secret: renew error: %v", name, err)
+			}
+			return true
+
+		case info := <-watcher.RenewCh():
+			log.Printf("%q secret: successfully renewed; remaining lease duration: %ds", name, info.Secret.LeaseDuration)
+		}
+	}
+}
+
+// RevokeSecretLeases revokes the current leases of the declared secrets
+func (v *Vault) RevokeSecretLeases(ctx context.Context) error {
+	for _, lease := range v.namedSecrets.currentLeases() {
+		if err := v.RevokeLease(ctx, lease); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// refreshSecret reads the secret from vault & keeps it, unless its refresh
+// policy is "always"
+func (v *Vault) refreshSecret(ctx context.Context, name string, definition SecretDefinition) (SecretValue, error) {
+	value, lease, err := v.readSecret(ctx, name, definition)
+	if err != nil {
+		return SecretValue{}, err
+	}
+
+	if definition.Refresh != SecretRefreshAlways {
+		v.namedSecrets.set(name, value, lease)
+	}
+
+	return value, nil
+}
+
+// readSecret reads the secret from its secrets engine; the lease is only
+// returned for leased secrets
+func (v *Vault) readSecret(ctx context.Context, name string, definition SecretDefinition) (SecretValue, *vault.Secret, error) {
+	log.Printf("getting %q secret from vault", name)
+
+	value := SecretValue{
+		Name:      name,
+		FetchedAt: time.Now(),
+	}
+
+	var lease *vault.Secret
+
+	switch definition.Engine {
+	case SecretEngineKVv2:
+		secret, err := v.client.KVv2(definition.Mount).Get(ctx, definition.Path)
+		if err != nil {
+			return SecretValue{}, nil, fmt.Errorf("unable to read %q secret: %w", name, err)
+		}
+
+		value.Data = secret.Data
+
+		if secret.VersionMetadata != nil {
+			value.Version = secret.VersionMetadata.Version
+		}
+
+	case SecretEngineKVv1:
+		secret, err := v.client.KVv1(definition.Mount).Get(ctx, definition.Path)
+		if err != nil {
+			return SecretValue{}, nil, fmt.Errorf("unable to read %q secret: %w", name, err)
+		}
+
+		value.Data = secret.Data
+
+	case SecretEngineDatabase:
+		secret, err := v.client.Logical().ReadWithContext(ctx, definition.Mount+"/creds/"+definition.Path)
+		if err != nil {
+			return SecretValue{}, nil, fmt.Errorf("unable to read %q secret: %w", name, err)
+		}
+		if secret == nil {
+			return SecretValue{}, nil, fmt.Errorf("unable to read %q secret: %w", name, ErrVaultNotFound)
+		}
+
+		value.Data = secret.Data
+		value.LeaseID = secret.LeaseID
+		value.LeaseDuration = time.Duration(secret.LeaseDuration) * time.Second
+
+		lease = secret
+
+	default:
+		return SecretValue{}, nil, fmt.Errorf("unable to read %q secret: unknown engine %q", name, definition.Engine)
+	}
+
+	// only the declared fields are exposed, and they must all be there
+	if len(definition.Fields) > 0 {
+		data := make(map[string]interface{}, len(definition.Fields))
+
+		for _, field := range definition.Fields {
+			fieldValue, ok := value.Data[field]
+			if !ok {
+				return SecretValue{}, nil, fmt.Errorf("the %q secret retrieved from vault is missing %q field", name, field)
+			}
+			data[field] = fieldValue
+		}
+
+		value.Data = data
+	}
+
+	log.Printf("getting %q secret from vault: success!", name)
+
+	return value, lease, nil
+}
+
+func (v *Vault) secretNames() []string {
+	names := make([]string, 0, len(v.parameters.secrets))
+	for name := range v.parameters.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,292 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// TransitInput is a single item to be encrypted, decrypted or rewrapped by
+// the transit secrets engine
+//
+// ref: https://www.vaultproject.io/api-docs/secret/transit
+type TransitInput struct {
+	Plaintext      []byte // encrypt only
+	Ciphertext     string // decrypt & rewrap only
+	Context        []byte // required for keys with key derivation enabled
+	AssociatedData []byte // authenticated but not encrypted (AEAD keys only)
+	KeyVersion     int    // encrypt & rewrap only; 0 means the version requested for the whole batch
+}
+
+// TransitResult is the result of a single TransitInput
+type TransitResult struct {
+	Plaintext  []byte // decrypt only
+	Ciphertext string // encrypt & rewrap only
+	KeyVersion int    // the key version used to encrypt (encrypt & rewrap only)
+	Error      string // set if this particular item has failed
+}
+
+// transitBatchResult is the raw result of a single batch item as returned by Vault
+type transitBatchResult struct {
+	Plaintext  string `json:"plaintext"`
+	Ciphertext string `json:"ciphertext"`
+	KeyVersion int    `json:"key_version"`
+	Error      string `json:"error"`
+}
+
+// TransitEncrypt encrypts the given plaintext using the named key from the
+// transit secrets engine. The key never leaves Vault; only the ciphertext
+// (e.g. "vault:v1:...") is returned and can be safely stored elsewhere.
+//
+// ref: https://www.vaultproject.io/docs/secrets/transit
+func (v *Vault) TransitEncrypt(ctx context.Context, keyName string, plaintext string) (string, error) {
+	results, err := v.TransitEncryptBatch(ctx, keyName, 0, []TransitInput{{Plaintext: []byte(plaintext)}})
+	if err != nil {
+		return "", err
+	}
+	if results[0].Error != "" {
+		return "", fmt.Errorf("unable to encrypt data: %s", results[0].Error)
+	}
+
+	return results[0].Ciphertext, nil
+}
+
+// TransitDecrypt decrypts the given ciphertext (previously produced by
+// TransitEncrypt) using the named key from the transit secrets engine
+func (v *Vault) TransitDecrypt(ctx context.Context, keyName string, ciphertext string) (string, error) {
+	results, err := v.TransitDecryptBatch(ctx, keyName, []TransitInput{{Ciphertext: ciphertext}})
+	if err != nil {
+		return "", err
+	}
+	if results[0].Error != "" {
+		return "", fmt.Errorf("unable to decrypt data: %s", results[0].Error)
+	}
+
+	return string(results[0].Plaintext), nil
+}
+
+// TransitEncryptBatch encrypts all of the given inputs in a single request
+// with the given version of the key (0 means the latest version), unless an
+// input asks for a specific version itself.
+func (v *Vault) TransitEncryptBatch(ctx context.Context, keyName string, keyVersion int, inputs []TransitInput) ([]TransitResult, error) {
+	log.Printf("encrypting data with %q transit key", keyName)
+
+	batch := make([]map[string]interface{}, 0, len(inputs))
+	for _, input := range inputs {
+		item := transitBatchItem(input, keyVersion)
+		item["plaintext"] = base64.StdEncoding.EncodeToString(input.Plaintext)
+		batch = append(batch, item)
+	}
+
+	results, err := v.transitBatch(ctx, fmt.Sprintf("%s/encrypt/%s", v.parameters.transitMountPath, keyName), map[string]interface{}{
+		"batch_input": batch,
+	}, len(inputs))
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt data: %w", err)
+	}
+
+	log.Printf("encrypting data with %q transit key: success!", keyName)
+
+	return results, nil
+}
+
+// TransitDecryptBatch decrypts all of the given inputs in a single request
+func (v *Vault) TransitDecryptBatch(ctx context.Context, keyName string, inputs []TransitInput) ([]TransitResult, error) {
+	log.Printf("decrypting data with %q transit key", keyName)
+
+	batch := make([]map[string]interface{}, 0, len(inputs))
+	for _, input := range inputs {
+		item := transitBatchItem(input, 0) // the version is part of the ciphertext
+		item["ciphertext"] = input.Ciphertext
+		batch = append(batch, item)
+	}
+
+	results, err := v.transitBatch(ctx, fmt.Sprintf("%s/decrypt/%s", v.parameters.transitMountPath, keyName), map[string]interface{}{
+		"batch_input": batch,
+	}, len(inputs))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt data: %w", err)
+	}
+
+	log.Printf("decrypting data with %q transit key: success!", keyName)
+
+	return results, nil
+}
+
+// TransitRewrapBatch re-encrypts the given ciphertexts with the given version
+// of the key (0 means the latest version), unless an input asks for a
+// specific version itself, without ever exposing the plaintext; typically
+// used after the key has been rotated
+func (v *Vault) TransitRewrapBatch(ctx context.Context, keyName string, keyVersion int, inputs []TransitInput) ([]TransitResult, error) {
+	log.Printf("rewrapping data with %q transit key", keyName)
+
+	batch := make([]map[string]interface{}, 0, len(inputs))
+	for _, input := range inputs {
+		item := transitBatchItem(input, keyVersion)
+		item["ciphertext"] = input.Ciphertext
+		batch = append(batch, item)
+	}
+
+	results, err := v.transitBatch(ctx, fmt.Sprintf("%s/rewrap/%s", v.parameters.transitMountPath, keyName), map[string]interface{}{
+		"batch_input": batch,
+	}, len(inputs))
+	if err != nil {
+		return nil, fmt.Errorf("unable to rewrap data: %w", err)
+	}
+
+	log.Printf("rewrapping data with %q transit key: success!", keyName)
+
+	return results, nil
+}
+
+// TransitRotateKey generates a new version of the named key, which will be
+// used for all new encryptions; older versions can still decrypt existing
+// ciphertexts. Returns the new latest version of the key.
+func (v *Vault) TransitRotateKey(ctx context.Context, keyName string) (int, error) {
+	log.Printf("rotating %q transit key", keyName)
+
+	if _, err := v.client.Logical().WriteWithContext(ctx, fmt.Sprintf("%s/keys/%s/rotate", v.parameters.transitMountPath, keyName), nil); err != nil {
+		return 0, fmt.Errorf("unable to rotate key: %w", err)
+	}
+
+	// older versions of Vault don't return the key info after rotation
+	path := fmt.Sprintf("%s/keys/%s", v.parameters.transitMountPath, keyName)
+
+	secret, err := v.client.Logical().ReadWithContext(ctx, path)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read key: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return 0, fmt.Errorf("no data was returned from %q", path)
+	}
+
+	b, err := json.Marshal(secret.Data)
+	if err != nil {
+		return 0, fmt.Errorf("malformed key info returned: %w", err)
+	}
+
+	var key struct {
+		LatestVersion int `json:"latest_version"`
+	}
+
+	if err := json.Unmarshal(b, &key); err != nil {
+		return 0, fmt.Errorf("unable to unmarshal key info: %w", err)
+	}
+
+	log.Printf("rotating %q transit key: success! (version %d)", keyName, key.LatestVersion)
+
+	return key.LatestVersion, nil
+}
+
+// transitBatchItem converts the fields common to all operations into a
+// batch_input item. The key version must be set on each item: vault ignores
+// a top-level key_version once batch_input is given.
+func transitBatchItem(input TransitInput, keyVersion int) map[string]interface{} {
+	item := make(map[string]interface{})
+
+	if input.KeyVersion != 0 {
+		keyVersion = input.KeyVersion
+	}
+	if keyVersion != 0 {
+		item["key_version"] = keyVersion
+	}
+
+	if len(input.Context) != 0 {
+		item["context"] = base64.StdEncoding.EncodeToString(input.Context)
+	}
+	if len(input.AssociatedData) != 0 {
+		item["associated_data"] = base64.StdEncoding.EncodeToString(input.AssociatedData)
+	}
+
+	return item
+}
+
+// transitBatch sends a batch request to the given transit endpoint and parses the batch_results
+func (v *Vault) transitBatch(ctx context.Context, path string, data map[string]interface{}, expected int) ([]TransitResult, error) {
+	// vault responds with 400 to the whole batch if any single item fails;
+	// since vault 1.12, partial_failure_response_code turns that into a 200
+	// (older versions ignore it). Either way, each item's error is reported
+	// in its own result, which is why the body of a 400 is parsed as well.
+	data["partial_failure_response_code"] = http.StatusOK
+
+	secret, err := v.writeBatch(ctx, path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(secret.Data["batch_results"])
+	if err != nil {
+		return nil, fmt.Errorf("malformed batch results returned: %w", err)
+	}
+
+	var batchResults []transitBatchResult
+
+	if err := json.Unmarshal(b, &batchResults); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal batch results: %w", err)
+	}
+
+	if len(batchResults) != expected {
+		return nil, fmt.Errorf("expected %d batch results from %q, got %d", expected, path, len(batchResults))
+	}
+
+	results := make([]TransitResult, 0, len(batchResults))
+
+	for i, r := range batchResults {
+		result := TransitResult{
+			Ciphertext: r.Ciphertext,
+			KeyVersion: r.KeyVersion,
+			Error:      r.Error,
+		}
+
+		if r.Plaintext != "" {
+			plaintext, err := base64.StdEncoding.DecodeString(r.Plaintext)
+			if err != nil {
+				return nil, fmt.Errorf("malformed plaintext returned for batch item %d: %w", i, err)
+			}
+			result.Plaintext = plaintext
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// writeBatch writes the batch request & returns the parsed response. Unlike
+// Logical().WriteWithContext, which discards the body of error responses, the
+// batch_results of a 400 are returned; the error is only returned if there
+// are none (e.g. the request itself was invalid).
+func (v *Vault) writeBatch(ctx context.Context, path string, data map[string]interface{}) (*vault.Secret, error) {
+	request := v.client.NewRequest(http.MethodPut, "/v1/"+path)
+
+	if err := request.SetJSONBody(data); err != nil {
+		return nil, fmt.Errorf("unable to encode batch request: %w", err)
+	}
+
+	//lint:ignore SA1019 the body of 400 responses is only available through a raw request
+	response, err := v.client.RawRequestWithContext(ctx, request)
+	if response != nil {
+		defer response.Body.Close()
+	}
+	if err != nil && (response == nil || response.StatusCode != http.StatusBadRequest) {
+		return nil, err
+	}
+
+	secret, parseErr := vault.ParseSecret(response.Body)
+	if parseErr != nil || secret == nil || secret.Data == nil || secret.Data["batch_results"] == nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no batch results were returned from %q", path)
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+)
+
+// TransitHMAC computes the HMAC (sha2-256) of the given input with the named
+// key from the transit secrets engine. The key never leaves Vault; the
+// returned value is prefixed with the key version (e.g. "vault:v1:...").
+//
+// ref: https://www.vaultproject.io/api-docs/secret/transit#generate-hmac
+func (v *Vault) TransitHMAC(ctx context.Context, keyName string, input []byte) (string, error) {
+	log.Printf("generating hmac with %q transit key", keyName)
+
+	hmac, err := v.transitWriteString(ctx, fmt.Sprintf("%s/hmac/%s", v.parameters.transitMountPath, keyName), map[string]interface{}{
+		"input": base64.StdEncoding.EncodeToString(input),
+	}, "hmac")
+	if err != nil {
+		return "", fmt.Errorf("unable to generate hmac: %w", err)
+	}
+
+	log.Printf("generating hmac with %q transit key: success!", keyName)
+
+	return hmac, nil
+}
+
+// TransitSign signs the given input with the named asymmetric key from the
+// transit secrets engine; the signature can be verified by anyone with the
+// key's public key (readable from transit/keys/<name>)
+//
+// ref: https://www.vaultproject.io/api-docs/secret/transit#sign-data
+func (v *Vault) TransitSign(ctx context.Context, keyName string, input []byte) (string, error) {
+	log.Printf("signing data with %q transit key", keyName)
+
+	signature, err := v.transitWriteString(ctx, fmt.Sprintf("%s/sign/%s", v.parameters.transitMountPath, keyName), map[string]interface{}{
+		"input": base64.StdEncoding.EncodeToString(input),
+	}, "signature")
+	if err != nil {
+		return "", fmt.Errorf("unable to sign data: %w", err)
+	}
+
+	log.Printf("signing data with %q transit key: success!", keyName)
+
+	return signature, nil
+}
+
+// transitWriteString writes to the given transit endpoint and returns the
+// named string field of the response
+func (v *Vault) transitWriteString(ctx context.Context, path string, data map[string]interface{}, field string) (string, error) {
+	secret, err := v.client.Logical().WriteWithContext(ctx, path, data)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil || secret.Data == nil {
+		return "", fmt.Errorf("no data was returned from %q", path)
+	}
+
+	value, ok := secret.Data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected %q type returned from %q", field, path)
+	}
+
+	return value, nil
+}
+
+// TransitVerify checks the given hmac or signature (as returned by TransitHMAC
+// or TransitSign, e.g. "vault:v1:...") of the input with the named key from
+// the transit secrets engine
+//
+// ref: https://www.vaultproject.io/api-docs/secret/transit#verify-signed-data
+func (v *Vault) TransitVerify(ctx context.Context, keyName string, mode SigningMode, input []byte, signature string) (bool, error) {
+	log.Printf("verifying %s with %q transit key", mode, keyName)
+
+	data := map[string]interface{}{
+		"input": base64.StdEncoding.EncodeToString(input),
+	}
+
+	switch mode {
+	case SigningModeHMAC:
+		data["hmac"] = signature
+	case SigningModeSign:
+		data["signature"] = signature
+	default:
+		return false, fmt.Errorf("unknown signing mode %q", mode)
+	}
+
+	path := fmt.Sprintf("%s/verify/%s", v.parameters.transitMountPath, keyName)
+
+	secret, err := v.client.Logical().WriteWithContext(ctx, path, data)
+	if err != nil {
+		return false, fmt.Errorf("unable to verify %s: %w", mode, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return false, fmt.Errorf("no data was returned from %q", path)
+	}
+
+	valid, ok := secret.Data["valid"].(bool)
+	if !ok {
+		return false, fmt.Errorf("unexpected %q type returned from %q", "valid", path)
+	}
+
+	log.Printf("verifying %s with %q transit key: valid=%t", mode, keyName, valid)
+
+	return valid, nil
+}
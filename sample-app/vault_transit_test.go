@@ -0,0 +1,200 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// newTestVault returns a Vault whose client talks to the given handler
+// instead of a real vault server
+func newTestVault(t *testing.T, handler http.Handler) *Vault {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	config := vault.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+
+	client, err := vault.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("test-token")
+
+	return &Vault{
+		client: client,
+		parameters: VaultParameters{
+			transitMountPath: "transit",
+		},
+	}
+}
+
+// fakeTransit mimics the encrypt & rewrap endpoints of the transit secrets
+// engine for a key whose latest version is latestVersion: like vault, it only
+// looks at the key_version of each batch_input item
+func fakeTransit(t *testing.T, latestVersion int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			KeyVersion int `json:"key_version"`
+			BatchInput []struct {
+				Plaintext  string `json:"plaintext"`
+				Ciphertext string `json:"ciphertext"`
+				KeyVersion int    `json:"key_version"`
+			} `json:"batch_input"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("malformed request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		results := make([]map[string]interface{}, 0, len(request.BatchInput))
+
+		for _, item := range request.BatchInput {
+			version := item.KeyVersion
+			if version == 0 {
+				version = latestVersion
+			}
+
+			if version > latestVersion {
+				results = append(results, map[string]interface{}{"error": "requested version is greater than the latest version"})
+				continue
+			}
+
+			payload := item.Plaintext
+			if strings.HasSuffix(r.URL.Path, "/rewrap/app-data") {
+				payload = item.Ciphertext[strings.LastIndex(item.Ciphertext, ":")+1:]
+			}
+
+			results = append(results, map[string]interface{}{
+				"ciphertext":  fmt.Sprintf("vault:v%d:%s", version, payload),
+				"key_version": version,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"batch_results": results},
+		})
+	})
+}
+
+func TestTransitBatchKeyVersion(t *testing.T) {
+	v := newTestVault(t, fakeTransit(t, 3))
+
+	tests := []struct {
+		name       string
+		operation  func(ctx context.Context, keyName string, keyVersion int, inputs []TransitInput) ([]TransitResult, error)
+		input      TransitInput
+		keyVersion int
+		want       string
+	}{
+		{"encrypt with the latest version", v.TransitEncryptBatch, TransitInput{Plaintext: []byte("data")}, 0, "vault:v3:"},
+		{"encrypt with a pinned version", v.TransitEncryptBatch, TransitInput{Plaintext: []byte("data")}, 2, "vault:v2:"},
+		{"encrypt with an item's version", v.TransitEncryptBatch, TransitInput{Plaintext: []byte("data"), KeyVersion: 1}, 2, "vault:v1:"},
+		{"rewrap with the latest version", v.TransitRewrapBatch, TransitInput{Ciphertext: "vault:v1:ZGF0YQ=="}, 0, "vault:v3:"},
+		{"rewrap with a pinned version", v.TransitRewrapBatch, TransitInput{Ciphertext: "vault:v1:ZGF0YQ=="}, 2, "vault:v2:"},
+		{"rewrap with an item's version", v.TransitRewrapBatch, TransitInput{Ciphertext: "vault:v1:ZGF0YQ==", KeyVersion: 1}, 3, "vault:v1:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the second item always uses the version requested for the batch
+			inputs := []TransitInput{tt.input, {Plaintext: []byte("other"), Ciphertext: "vault:v1:b3RoZXI="}}
+
+			results, err := tt.operation(context.Background(), "app-data", tt.keyVersion, inputs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !strings.HasPrefix(results[0].Ciphertext, tt.want) {
+				t.Errorf("expected a ciphertext starting with %q, got %q", tt.want, results[0].Ciphertext)
+			}
+
+			batchVersion := tt.keyVersion
+			if batchVersion == 0 {
+				batchVersion = 3
+			}
+			if want := fmt.Sprintf("vault:v%d:", batchVersion); !strings.HasPrefix(results[1].Ciphertext, want) {
+				t.Errorf("expected a ciphertext starting with %q, got %q", want, results[1].Ciphertext)
+			}
+		})
+	}
+}
+
+func TestTransitItemKeyVersion(t *testing.T) {
+	input, err := TransitItem{Plaintext: "ZGF0YQ==", KeyVersion: 2}.input()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if input.KeyVersion != 2 {
+		t.Errorf("expected key version 2, got %d", input.KeyVersion)
+	}
+}
+
+func TestTransitBatchPartialFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		wantErr  error
+	}{
+		{
+			// vault < 1.12 ignores partial_failure_response_code
+			name:     "400 with batch results",
+			response: `{"data":{"batch_results":[{"plaintext":"ZGF0YQ=="},{"error":"invalid ciphertext: no prefix"}]}}`,
+		},
+		{
+			name:     "400 without batch results",
+			response: `{"errors":["missing batch input to process"]}`,
+			wantErr:  ErrVaultInvalidRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestVault(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(tt.response))
+			}))
+
+			results, err := v.TransitDecryptBatch(context.Background(), "app-data", []TransitInput{
+				{Ciphertext: "vault:v1:ZGF0YQ=="},
+				{Ciphertext: "not-a-ciphertext"},
+			})
+
+			if tt.wantErr != nil {
+				if vaultErrorKind(err) != tt.wantErr {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if string(results[0].Plaintext) != "data" || results[0].Error != "" {
+				t.Errorf("unexpected result for the valid item: %+v", results[0])
+			}
+
+			if results[1].Error == "" {
+				t.Errorf("expected an error for the invalid item, got %+v", results[1])
+			}
+		})
+	}
+}
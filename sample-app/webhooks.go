@@ -0,0 +1,328 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const webhookNonceHeader = "X-Webhook-Nonce"
+
+// WebhookVerification describes how the signatures of a provider's webhooks
+// are verified
+type WebhookVerification string
+
+const (
+	WebhookVerificationTransitHMAC WebhookVerification = "transit-hmac" // transit/verify/<key> with an hmac
+	WebhookVerificationTransitSign WebhookVerification = "transit-sign" // transit/verify/<key> with a signature
+	WebhookVerificationKV          WebhookVerification = "kv"           // hmac-sha256 with a shared secret stored in kv-v2
+)
+
+var (
+	ErrWebhookUnknownProvider  = errors.New("unknown webhook provider")
+	ErrWebhookMissingSignature = errors.New("missing webhook signature, timestamp or nonce")
+	ErrWebhookInvalidSignature = errors.New("invalid webhook signature")
+	ErrWebhookExpired          = errors.New("webhook timestamp is outside of the accepted window")
+	ErrWebhookReplayed         = errors.New("webhook has already been received")
+)
+
+// WebhookProvider is a sender of webhooks along with the Vault key or secret
+// its signatures are verified with
+type WebhookProvider struct {
+	Name         string
+	Verification WebhookVerification
+	Key          string // the transit key name, or the kv-v2 secret path
+}
+
+// ParseWebhookProviders parses provider definitions of the form
+// "<name>=<verification>:<key>", e.g. "acme=transit-hmac:acme-webhooks" or
+// "partner=kv:webhooks/partner"
+func ParseWebhookProviders(definitions []string) (map[string]WebhookProvider, error) {
+	providers := make(map[string]WebhookProvider, len(definitions))
+
+	for _, definition := range definitions {
+		definition = strings.TrimSpace(definition)
+		if definition == "" {
+			continue
+		}
+
+		name, rest, ok := strings.Cut(definition, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid webhook provider %q: expected <name>=<verification>:<key>", definition)
+		}
+
+		verification, key, ok := strings.Cut(rest, ":")
+		if !ok || name == "" || key == "" {
+			return nil, fmt.Errorf("invalid webhook provider %q: expected <name>=<verification>:<key>", definition)
+		}
+
+		switch WebhookVerification(verification) {
+		case WebhookVerificationTransitHMAC, WebhookVerificationTransitSign, WebhookVerificationKV:
+		default:
+			return nil, fmt.Errorf("invalid webhook provider %q: unknown verification %q", definition, verification)
+		}
+
+		if _, exists := providers[name]; exists {
+			return nil, fmt.Errorf("duplicate webhook provider %q", name)
+		}
+
+		providers[name] = WebhookProvider{
+			Name:         name,
+			Verification: WebhookVerification(verification),
+			Key:          key,
+		}
+	}
+
+	return providers, nil
+}
+
+// WebhookVerifier authenticates incoming webhooks. A webhook must carry:
+//
+//	X-Signature:           signature of the canonical request (see canonicalWebhook)
+//	X-Signature-Timestamp: unix seconds, within the tolerance of our clock
+//	X-Webhook-Nonce:       unique per webhook; replays are rejected
+//
+// The signature is checked against a key held in Vault: through transit
+// verify (the key never leaves Vault) or locally with a shared secret stored
+// in kv-v2 (hex-encoded hmac-sha256). Shared secrets are cached for kvCacheTTL.
+type WebhookVerifier struct {
+	vault     *Vault
+	providers map[string]WebhookProvider
+	tolerance time.Duration
+
+	kvMountPath string
+	kvField     string
+	kvCacheTTL  time.Duration
+
+	nonces  nonceCache
+	secrets webhookSecrets
+}
+
+func NewWebhookVerifier(v *Vault, providers map[string]WebhookProvider, tolerance time.Duration, kvMountPath, kvField string, kvCacheTTL time.Duration) *WebhookVerifier {
+	return &WebhookVerifier{
+		vault:       v,
+		providers:   providers,
+		tolerance:   tolerance,
+		kvMountPath: kvMountPath,
+		kvField:     kvField,
+		kvCacheTTL:  kvCacheTTL,
+		nonces: nonceCache{
+			seen: make(map[string]time.Time),
+		},
+		secrets: webhookSecrets{
+			secrets: make(map[string]webhookSecret),
+		},
+	}
+}
+
+// Verify authenticates the webhook sent by the given provider; the body must
+// be the exact request body. The nonce is only recorded once the signature
+// has been verified, so that forged requests cannot burn legitimate nonces.
+func (w *WebhookVerifier) Verify(ctx context.Context, providerName string, request *http.Request, body []byte) error {
+	provider, ok := w.providers[providerName]
+	if !ok {
+		return ErrWebhookUnknownProvider
+	}
+
+	signature := request.Header.Get(signatureHeader)
+	timestamp := request.Header.Get(signatureTimestampHeader)
+	nonce := request.Header.Get(webhookNonceHeader)
+
+	if signature == "" || timestamp == "" || nonce == "" {
+		return ErrWebhookMissingSignature
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrWebhookMissingSignature
+	}
+
+	sent := time.Unix(seconds, 0)
+
+	if age := time.Since(sent); age > w.tolerance || age < -w.tolerance {
+		return ErrWebhookExpired
+	}
+
+	canonical := canonicalWebhook(request, timestamp, nonce, body)
+
+	var valid bool
+
+	switch provider.Verification {
+	case WebhookVerificationTransitHMAC, WebhookVerificationTransitSign:
+		// vault rejects anything else as an invalid request; that is the
+		// sender's fault, not ours
+		if !isTransitSignature(signature) {
+			return ErrWebhookInvalidSignature
+		}
+
+		mode := map[WebhookVerification]SigningMode{
+			WebhookVerificationTransitHMAC: SigningModeHMAC,
+			WebhookVerificationTransitSign: SigningModeSign,
+		}[provider.Verification]
+
+		valid, err = w.vault.TransitVerify(ctx, provider.Key, mode, canonical, signature)
+		if vaultErrorKind(err) == ErrVaultInvalidRequest {
+			return ErrWebhookInvalidSignature // e.g. the rest of the signature is not valid base64
+		}
+
+	case WebhookVerificationKV:
+		var (
+			secret  string
+			fetched bool
+		)
+
+		secret, fetched, err = w.sharedSecret(ctx, provider, w.kvCacheTTL)
+		if err == nil {
+			valid = verifyHMACSHA256([]byte(secret), canonical, signature)
+		}
+
+		// the secret may have been rotated since it was cached
+		if err == nil && !valid && !fetched {
+			secret, fetched, err = w.sharedSecret(ctx, provider, webhookSecretMinRefreshInterval)
+			if err == nil && fetched {
+				valid = verifyHMACSHA256([]byte(secret), canonical, signature)
+			}
+		}
+
+	default:
+		err = fmt.Errorf("unknown webhook verification %q", provider.Verification)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to verify webhook signature: %w", err)
+	}
+
+	if !valid {
+		return ErrWebhookInvalidSignature
+	}
+
+	// remember the nonce until its timestamp falls out of the accepted window
+	if !w.nonces.add(provider.Name+":"+nonce, sent.Add(w.tolerance)) {
+		return ErrWebhookReplayed
+	}
+
+	return nil
+}
+
+// sharedSecret returns the kv-v2 shared secret of the provider, reading it
+// from Vault unless the cached one was read within maxAge; fetched reports
+// whether it was just read
+func (w *WebhookVerifier) sharedSecret(ctx context.Context, provider WebhookProvider, maxAge time.Duration) (secret string, fetched bool, err error) {
+	/* */ w.secrets.mutex.Lock()
+	defer w.secrets.mutex.Unlock()
+
+	if cached, ok := w.secrets.secrets[provider.Name]; ok && time.Since(cached.fetchedAt) < maxAge {
+		return cached.value, false, nil
+	}
+
+	secret, err = w.vault.GetKVSecretField(ctx, w.kvMountPath, provider.Key, w.kvField)
+	if err != nil {
+		return "", false, err
+	}
+
+	w.secrets.secrets[provider.Name] = webhookSecret{
+		value:     secret,
+		fetchedAt: time.Now(),
+	}
+
+	return secret, true, nil
+}
+
+// canonicalWebhook is what the provider signs; it is the same as the
+// canonical form of our outbound requests (see canonicalRequest) with the
+// nonce added after the timestamp:
+//
+//	METHOD\n
+//	PATH[?QUERY]\n
+//	TIMESTAMP\n
+//	NONCE\n
+//	HEX(SHA256(BODY))
+func canonicalWebhook(request *http.Request, timestamp, nonce string, body []byte) []byte {
+	return canonicalRequest(request, timestamp+"\n"+nonce, body)
+}
+
+// isTransitSignature reports whether the signature has the "vault:v<N>:"
+// prefix of transit hmacs & signatures
+func isTransitSignature(signature string) bool {
+	rest, ok := strings.CutPrefix(signature, "vault:v")
+	if !ok {
+		return false
+	}
+
+	version, _, ok := strings.Cut(rest, ":")
+	if !ok {
+		return false
+	}
+
+	_, err := strconv.ParseUint(version, 10, 64)
+
+	return err == nil
+}
+
+// verifyHMACSHA256 compares the hex-encoded hmac-sha256 signature in constant time
+func verifyHMACSHA256(secret, input []byte, signature string) bool {
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(input)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// webhookSecretMinRefreshInterval limits how often a cached shared secret is
+// read again from Vault when a signature does not match it (e.g. after the
+// secret was rotated), so that forged webhooks cannot hammer Vault
+const webhookSecretMinRefreshInterval = 10 * time.Second
+
+// webhookSecrets caches the kv-v2 shared secrets of the providers, by name
+type webhookSecrets struct {
+	mutex   sync.Mutex
+	secrets map[string]webhookSecret
+}
+
+type webhookSecret struct {
+	value     string
+	fetchedAt time.Time
+}
+
+// nonceCache remembers the nonces of accepted webhooks until they expire
+type nonceCache struct {
+	mutex sync.Mutex
+	seen  map[string]time.Time // nonce => expiration
+}
+
+// add records the nonce and reports whether it had not been seen before
+func (c *nonceCache) add(nonce string, expiration time.Time) bool {
+	/* */ c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+
+	// evict expired nonces so that the cache does not grow unbounded
+	for n, e := range c.seen {
+		if now.After(e) {
+			delete(c.seen, n)
+		}
+	}
+
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+
+	c.seen[nonce] = expiration
+
+	return true
+}
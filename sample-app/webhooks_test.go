@@ -0,0 +1,118 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeWebhookSecret mimics a kv-v2 secret holding the current shared secret,
+// counting the reads
+func fakeWebhookSecret(current *atomic.Value, reads *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(reads, 1)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     map[string]interface{}{"secret": current.Load()},
+				"metadata": map[string]interface{}{"version": 1, "created_time": "2022-01-11T20:00:00Z"},
+			},
+		})
+	})
+}
+
+// signedWebhook returns a webhook from the "example" provider signed with the
+// given shared secret
+func signedWebhook(secret string, nonce int) (*http.Request, []byte) {
+	body := []byte(`{"event":"payment.settled"}`)
+
+	request := httptest.NewRequest(http.MethodPost, "/webhooks/example", bytes.NewReader(body))
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceValue := fmt.Sprintf("nonce-%d", nonce)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(canonicalWebhook(request, timestamp, nonceValue, body))
+
+	request.Header.Set(signatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	request.Header.Set(signatureTimestampHeader, timestamp)
+	request.Header.Set(webhookNonceHeader, nonceValue)
+
+	return request, body
+}
+
+func TestWebhookSharedSecretCache(t *testing.T) {
+	var (
+		current atomic.Value
+		reads   int32
+	)
+	current.Store("first-secret")
+
+	verifier := NewWebhookVerifier(
+		newTestVault(t, fakeWebhookSecret(&current, &reads)),
+		map[string]WebhookProvider{"example": {Name: "example", Verification: WebhookVerificationKV, Key: "webhooks/example"}},
+		time.Minute,
+		"kv-v2",
+		"secret",
+		time.Minute,
+	)
+
+	verify := func(secret string, nonce int) error {
+		request, body := signedWebhook(secret, nonce)
+		return verifier.Verify(context.Background(), "example", request, body)
+	}
+
+	// the secret is read once, then cached
+	for nonce := 0; nonce < 3; nonce++ {
+		if err := verify("first-secret", nonce); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&reads); n != 1 {
+		t.Fatalf("expected the secret to be read once, got %d", n)
+	}
+
+	// a webhook signed with a rotated secret causes the cached one to be read
+	// again, once it is older than the minimum refresh interval
+	current.Store("second-secret")
+
+	verifier.secrets.secrets["example"] = webhookSecret{
+		value:     "first-secret",
+		fetchedAt: time.Now().Add(-webhookSecretMinRefreshInterval),
+	}
+
+	if err := verify("second-secret", 3); err != nil {
+		t.Fatalf("unexpected error after the rotation: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&reads); n != 2 {
+		t.Fatalf("expected the rotated secret to be read, got %d reads", n)
+	}
+
+	// forged webhooks do not cause more reads within the minimum refresh interval
+	for nonce := 4; nonce < 7; nonce++ {
+		if err := verify("forged-secret", nonce); !errors.Is(err, ErrWebhookInvalidSignature) {
+			t.Fatalf("expected %v, got %v", ErrWebhookInvalidSignature, err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&reads); n != 2 {
+		t.Errorf("expected no more reads for forged webhooks, got %d", n)
+	}
+}